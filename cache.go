@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A resultCache holds the results of earlier runs, from the -cache file,
+// for reuse within -cache-ttl. The file has the format of the -checkpoint
+// file.
+type resultCache struct {
+	path    string
+	entries map[string]checkpointEntry
+}
+
+// loadCache reads the cache file at path, which need not exist, dropping
+// the entries checked ttl or more before now.
+func loadCache(path string, ttl time.Duration, now time.Time) (*resultCache, error) {
+	entries, err := readCheckpoint(path)
+	if errors.Is(err, os.ErrNotExist) {
+		entries, err = make(map[string]checkpointEntry), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for k, e := range entries {
+		checked, err := time.Parse(time.RFC3339, e.CheckedAt)
+		if err != nil || now.Sub(checked) >= ttl {
+			delete(entries, k)
+		}
+	}
+	return &resultCache{path: path, entries: entries}, nil
+}
+
+// cacheKey returns the name of t in the cache and checkpoint files: the
+// host and port dialed, followed by the name sent for SNI if given, and the
+// address dialed, if any. Unlike displayName, it differs between targets.
+func cacheKey(t target) string {
+	k := t.domain
+	if _, ok := t.unixPath(); !ok {
+		k = net.JoinHostPort(t.hostPort())
+	}
+	if t.serverName != "" {
+		k += " " + t.serverName
+	}
+	if t.ip != "" {
+		k += " (" + t.ip + ")"
+	}
+	return k
+}
+
+// lookup returns the cached entry for t. A nil cache has no entries.
+func (c *resultCache) lookup(t target) (checkpointEntry, bool) {
+	if c == nil {
+		return checkpointEntry{}, false
+	}
+	e, ok := c.entries[cacheKey(t)]
+	return e, ok
+}
+
+// item returns the Item cached in e for t, as check would report it.
+func (c *resultCache) item(e checkpointEntry, t target) Item {
+	i := e.item(t, "the cache")
+	i.domain = t.displayName()
+	if fRedact.value != "none" {
+		i = redact(i, t)
+	}
+	if previous != nil {
+		// drop the comparison made by the run that cached e, so that it is
+		// not repeated.
+		var findings []string
+		for _, f := range i.findings {
+			if !strings.HasPrefix(f, replacedFinding) {
+				findings = append(findings, f)
+			}
+		}
+		i.findings = findings
+		i = compare(i, time.Now())
+	}
+	return i
+}
+
+// add caches the result i, checked at now, for t. Results other than
+// successful checks are not cached, so that they are retried by the next
+// run.
+func (c *resultCache) add(t target, i Item, now time.Time) {
+	if i.err != nil || i.skipped {
+		return
+	}
+	c.entries[cacheKey(t)] = newCheckpointEntry(cacheKey(t), i, now)
+}
+
+// write replaces the cache file with the entries in c.
+func (c *resultCache) write() error {
+	keys := make([]string, 0, len(c.entries))
+	for k := range c.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	f, err := os.CreateTemp(filepath.Dir(c.path), ".notafter-cache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+	for _, k := range keys {
+		b, err := json.Marshal(c.entries[k])
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := f.Write(append(b, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errHandshakeAborted is reported when the server accepts the connection
+// but closes it during the TLS handshake.
+var errHandshakeAborted = errors.New("handshake aborted by server")
+
+// errTooManyOpenFiles is reported in place of a dial error caused by
+// reaching the open file limit, which otherwise looks like a network problem.
+var errTooManyOpenFiles = errors.New("too many open files; lower -j or raise the open file limit (ulimit -n)")
+
+// checkTimeout bounds each check. It is defaultCheckTimeout unless set
+// from -total-budget.
+var checkTimeout = defaultCheckTimeout
+
+const (
+	defaultCheckTimeout = 5 * time.Second
+	minCheckTimeout     = time.Second // floor for -total-budget
+)
+
+// budgetTimeout returns the timeout for each of n checks, run jobs at a time
+// (0 for no limit), such that all of them finish within budget.
+func budgetTimeout(budget time.Duration, n, jobs int) time.Duration {
+	rounds := 1
+	if jobs > 0 && n > jobs {
+		rounds = (n + jobs - 1) / jobs
+	}
+	if t := budget / time.Duration(rounds); t > minCheckTimeout {
+		return t
+	}
+	return minCheckTimeout
+}
+
+// maxRedirects is the number of redirects followed with -follow.
+const maxRedirects = 10
+
+// A connResult is what was learned by connecting to a target.
+type connResult struct {
+	state     tls.ConnectionState
+	redirects []string          // hosts redirected to, with -follow
+	probeCert *x509.Certificate // leaf before -probe-line, if the cert changed
+	hsts      string            // description of the HSTS policy, with -check-hsts
+}
+
+// errTooManyErrors is returned by checkAll when -max-errors is reached.
+var errTooManyErrors = errors.New("too many errors")
+
+// errTimedOut is reported for targets not checked before -deadline.
+var errTimedOut = errors.New("timed out: not checked before -deadline")
+
+// checkAll checks each of ts concurrently, with at most -j checks at a time,
+// and returns the results in the same order. If done is non-nil, it is
+// called with the index in ts of each result as it becomes available; calls
+// are serialized.
+//
+// With -ramp-duration, the first checks are started gradually rather than
+// all at once.
+//
+// If -max-errors checks fail, the remaining checks are abandoned and
+// errTooManyErrors is returned. If deadline, the end of -deadline if
+// non-zero, passes first, checkAll returns without waiting for the checks in
+// progress, and the unfinished ones are reported with errTimedOut.
+func checkAll(ctx context.Context, ts []target, deadline time.Time, done func(int, Item)) ([]Item, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	items := make([]Item, len(ts))
+
+	var sem chan struct{}
+	peak := len(ts)
+	if n := fJobs.limit(); n > 0 {
+		sem = make(chan struct{}, n)
+		if n < peak {
+			peak = n
+		}
+	}
+	r := &ramp{start: time.Now(), duration: fRampDuration, peak: peak}
+
+	var (
+		mu       sync.Mutex // guards the fields below and items; serializes calls to done
+		finished = make([]bool, len(ts))
+		errs     int
+		aborted  bool
+		timedOut bool
+	)
+	var wg sync.WaitGroup
+	for i := range ts {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			if sem != nil {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+			}
+			r.wait(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			item := safeCheck(ctx, ts[idx])
+
+			mu.Lock()
+			defer mu.Unlock()
+			if aborted || timedOut {
+				return
+			}
+			items[idx] = item
+			finished[idx] = true
+			if item.err != nil && !item.skipped {
+				errs++
+				if fMaxErrors > 0 && errs >= fMaxErrors {
+					aborted = true
+					cancel()
+				}
+			}
+			if done != nil {
+				done(idx, item)
+			}
+		}(i)
+	}
+
+	all := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(all)
+	}()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-all:
+	case <-expired:
+		mu.Lock()
+		defer mu.Unlock()
+		if aborted {
+			return nil, errTooManyErrors
+		}
+		timedOut = true
+		for idx, ok := range finished {
+			if ok {
+				continue
+			}
+			items[idx] = newItem(ts[idx], connResult{}, errTimedOut)
+			if fRedact.value != "none" {
+				items[idx] = redact(items[idx], ts[idx])
+			}
+			if done != nil {
+				done(idx, items[idx])
+			}
+		}
+		return items, nil
+	}
+	if aborted {
+		return nil, errTooManyErrors
+	}
+	return items, nil
+}
+
+// A ramp spreads the start of the first peak checks evenly over duration,
+// so that concurrency grows to its peak instead of starting there.
+type ramp struct {
+	start    time.Time
+	duration time.Duration
+	peak     int
+
+	mu      sync.Mutex
+	started int
+}
+
+// wait blocks until the next check may start, or ctx is done.
+func (r *ramp) wait(ctx context.Context) {
+	if r.duration <= 0 {
+		return
+	}
+	r.mu.Lock()
+	n := r.started
+	r.started++
+	r.mu.Unlock()
+	if n >= r.peak {
+		return
+	}
+	delay := time.Until(r.start.Add(r.duration * time.Duration(n) / time.Duration(r.peak)))
+	if delay <= 0 {
+		return
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// checkFunc is the function safeCheck calls to check a target; tests
+// replace it.
+var checkFunc = check
+
+// safeCheck is checkFunc, except that a panic, such as from a bug triggered
+// by an unusual cert, becomes the error of the result instead of ending the
+// run. The stack is logged so that the bug can be reported.
+func safeCheck(ctx context.Context, t target) (i Item) {
+	defer func() {
+		if r := recover(); r != nil {
+			i = newItem(t, connResult{}, fmt.Errorf("internal error: %v", r))
+			if fRedact.value != "none" {
+				i = redact(i, t)
+			}
+			log.Printf("panic checking %s: %v\n%s", i.domain, r, debug.Stack())
+		}
+	}()
+	return checkFunc(ctx, t)
+}
+
+// check connects to t and returns the result.
+func check(ctx context.Context, t target) Item {
+	start := time.Now()
+	var r connResult
+	var err error
+	if _, ok := t.unixPath(); fFollow && !ok && startTLSProtocol(t) == "" {
+		r, err = getFinalConnState(ctx, t)
+	} else {
+		r, err = getConnState(ctx, t)
+	}
+	if isTooManyOpenFiles(err) {
+		err = errTooManyOpenFiles
+	}
+	i := newItem(t, r, err)
+	i.elapsed = time.Since(start)
+	ft := finalTarget(t, r)
+	if h := ctHost(ft); fCheckCT && err == nil && h != "" {
+		finding, detail := checkCT(ctx, h, r.state.PeerCertificates[0])
+		if finding != "" {
+			i.findings = append(i.findings, finding)
+		}
+		if detail != "" {
+			i.details = append(i.details, detail)
+		}
+	}
+	if _, isUnix := ft.unixPath(); fCheckDANE && err == nil && !isUnix && ctHost(ft) != "" {
+		finding, detail := checkDANE(ctx, ft, &r.state)
+		if finding != "" {
+			i.findings = append(i.findings, finding)
+		}
+		if detail != "" {
+			i.details = append(i.details, detail)
+		}
+	}
+	if fSkipUnresolved && unresolved(err) {
+		i.skipped = true
+	}
+	if fRedact.value != "none" {
+		i = redact(i, t)
+	}
+	if i.skipped {
+		log.Printf("skipping %s: %v", i.domain, i.err) // after redaction, which covers the error too
+	}
+	if previous != nil {
+		i = compare(i, time.Now())
+	}
+	return i
+}
+
+// unresolved reports whether err is the failure to find a host in DNS.
+func unresolved(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// finalTarget returns the target whose cert is in r, against which the
+// checks that depend on the name are made: t, or the last host redirected
+// to with -follow.
+func finalTarget(t target, r connResult) target {
+	if len(r.redirects) == 0 {
+		return t
+	}
+	return target{domain: r.redirects[len(r.redirects)-1]}
+}
+
+// getFinalConnState makes an HTTPS GET request to t, following redirects,
+// and returns the connection state for the final response along with the
+// hosts redirected to. Redirects to the same host are not recorded, and
+// connections to it are made to t's address, if any. Annotations on t do
+// not apply, since they may not suit the other hosts.
+func getFinalConnState(ctx context.Context, t target) (connResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	first, _ := t.hostPort()
+	var hops []string
+	client := &http.Client{
+		Transport: &http.Transport{
+			// the handshake is made here, rather than by the transport, so
+			// that its errors are reported as by getConnState.
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				d, hosts := tcpDialer()
+				var conn net.Conn
+				if t.ip != "" && host == first {
+					conn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(t.ip, port))
+				} else {
+					conn, err = dialHost(ctx, d, hosts, host, port)
+				}
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: host})
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, handshakeError(err)
+				}
+				return tlsConn, nil
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("redirected to non-https URL %s", req.URL)
+			}
+			if req.URL.Host != via[len(via)-1].URL.Host {
+				hops = append(hops, req.URL.Host)
+			}
+			return nil
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+t.domain+"/", nil)
+	if err != nil {
+		return connResult{}, err
+	}
+	resp, err := client.Do(req)
+	if errors.Is(err, errHandshakeAborted) {
+		err = errHandshakeAborted
+	}
+	if err != nil {
+		return connResult{redirects: hops}, err
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return connResult{redirects: hops}, errors.New("no peer certificates")
+	}
+	r := connResult{state: *resp.TLS, redirects: hops}
+	if fCheckHSTS {
+		r.hsts = describeHSTS(resp.Header.Get("Strict-Transport-Security"))
+	}
+	return r, nil
+}
+
+func getConnState(ctx context.Context, t target) (connResult, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         t.hostname(),
+	}
+	probeLine := fProbeLine
+	if fHostHeader != "" {
+		probeLine = hostRequest(fHostHeader)
+	}
+	if probeLine != "" {
+		config.Renegotiation = tls.RenegotiateOnceAsClient
+	}
+	if fWeakCiphers {
+		// Offer the weak suites too, so that a server that prefers them
+		// can be detected.
+		config.MinVersion = tls.VersionTLS10
+		config.CipherSuites = allCipherSuites()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	conn, err := dialTarget(ctx, t)
+	if err != nil {
+		return connResult{}, err
+	}
+	defer conn.Close()
+
+	proto := startTLSProtocol(t)
+	if proto != "" {
+		if err := startTLS(ctx, conn, proto); err != nil {
+			return connResult{}, fmt.Errorf("%s STARTTLS: %w", strings.ToUpper(proto), err)
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return connResult{}, handshakeError(err)
+	}
+
+	cs := tlsConn.ConnectionState()
+	if len(cs.PeerCertificates) == 0 {
+		return connResult{}, errors.New("no peer certificates")
+	}
+	r := connResult{state: cs}
+
+	if probeLine != "" {
+		if err := probe(ctx, tlsConn, probeLine); err != nil {
+			return connResult{}, fmt.Errorf("probe: %w", err)
+		}
+		after := tlsConn.ConnectionState()
+		if len(after.PeerCertificates) != 0 && !after.PeerCertificates[0].Equal(cs.PeerCertificates[0]) {
+			r = connResult{state: after, probeCert: cs.PeerCertificates[0]}
+		}
+	}
+	if fCheckHSTS {
+		switch {
+		case probeLine != "":
+			r.hsts = "HSTS not checked, since the connection was used to probe"
+		case proto != "":
+			r.hsts = "HSTS not checked, since the server speaks " + strings.ToUpper(proto)
+		default:
+			v, err := headHSTS(ctx, tlsConn, t.hostname())
+			if err != nil {
+				r.hsts = fmt.Sprintf("HSTS not checked: %v", err)
+			} else {
+				r.hsts = describeHSTS(v)
+			}
+		}
+	}
+	return r, nil
+}
+
+// probeReadTimeout bounds the wait for a response to -probe-line.
+const probeReadTimeout = 2 * time.Second
+
+// probe writes line to conn and reads the start of the response, giving the
+// server the opportunity to renegotiate and present a different cert. A
+// server that does not respond in time, or closes the connection, is not an
+// error.
+func probe(ctx context.Context, conn *tls.Conn, line string) error {
+	deadline := time.Now().Add(probeReadTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if _, err := io.WriteString(conn, line+"\r\n"); err != nil {
+		return err
+	}
+	var buf [1]byte
+	_, err := conn.Read(buf[:])
+	var netErr net.Error
+	if err == nil || errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return nil
+	}
+	return err
+}
+
+// headHSTS makes an HTTP HEAD request for host over conn and returns the
+// response's Strict-Transport-Security header, which is empty if there is
+// none.
+func headHSTS(ctx context.Context, conn *tls.Conn, host string) (string, error) {
+	if host == "" {
+		host = "localhost"
+	}
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	req, err := http.NewRequest("HEAD", "https://"+host+"/", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Strict-Transport-Security"), nil
+}
+
+// describeHSTS describes the Strict-Transport-Security header value v.
+func describeHSTS(v string) string {
+	if v == "" {
+		return "no HSTS header"
+	}
+	for _, d := range strings.Split(v, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		secs, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+		if err != nil {
+			break
+		}
+		if days := secs / (24 * 60 * 60); days > 0 {
+			return fmt.Sprintf("HSTS max-age %d (%d %s)", secs, days, pluralize(days, "day"))
+		}
+		return fmt.Sprintf("HSTS max-age %d", secs)
+	}
+	return fmt.Sprintf("HSTS header without a valid max-age: %q", v)
+}
+
+// hostRequest returns the probe for -host-header: the start of an HTTP
+// request with the Host header host, which probe completes.
+func hostRequest(host string) string {
+	return "HEAD / HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n"
+}
+
+// dialTarget opens the connection, before the TLS handshake, for t.
+func dialTarget(ctx context.Context, t target) (net.Conn, error) {
+	if path, ok := t.unixPath(); ok {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	d, hosts := tcpDialer()
+	host, port := t.hostPort()
+	if t.ip != "" {
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(t.ip, port))
+	}
+	return dialHost(ctx, d, hosts, host, port)
+}
+
+// tcpDialer returns the dialer for TCP connections and the cache to resolve
+// hosts through, if any. With -ssh, connections are tunneled through the
+// bastion, which resolves the hosts itself.
+func tcpDialer() (dialer, *hostCache) {
+	if fSSH != "" {
+		return sshDialer{}, nil
+	}
+	return &net.Dialer{}, hosts
+}
+
+// handshakeError distinguishes a server that closed or reset the connection
+// during the handshake from other handshake failures.
+func handshakeError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || isConnReset(err) {
+		return errHandshakeAborted
+	}
+	return err
+}
+
+func allCipherSuites() []uint16 {
+	var ids []uint16
+	for _, c := range tls.CipherSuites() {
+		ids = append(ids, c.ID)
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
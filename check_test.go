@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckAllRecoversPanic(t *testing.T) {
+	defer func(f func(context.Context, target) Item) { checkFunc = f }(checkFunc)
+	checkFunc = func(ctx context.Context, t target) Item {
+		if t.domain == "panic.example" {
+			panic("injected")
+		}
+		return Item{domain: t.displayName()}
+	}
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard) // the stack logged for the panic
+
+	ts := []target{{domain: "a.example"}, {domain: "panic.example"}, {domain: "b.example"}}
+	items, err := checkAll(context.Background(), ts, time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("checkAll: %v", err)
+	}
+	if err := items[1].err; err == nil || !strings.HasPrefix(err.Error(), "internal error: injected") {
+		t.Errorf("panicking target: got error %v, want internal error: injected", err)
+	}
+	for _, k := range []int{0, 2} {
+		if items[k].domain != ts[k].domain || items[k].err != nil {
+			t.Errorf("target %s: got domain %q, error %v; want it checked", ts[k].domain, items[k].domain, items[k].err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// A checkpointEntry is a line of the -checkpoint file: a completed result
+// and the target it is for.
+type checkpointEntry struct {
+	Target    string `json:"target"`     // cacheKey of the target, before -redact
+	CheckedAt string `json:"checked_at"` // RFC 3339, UTC
+	jsonItem
+
+	// fields of Item not in the -json output
+	PinMismatch bool     `json:"pin_mismatch,omitempty"`
+	SANs        []string `json:"sans,omitempty"`
+}
+
+// A checkpoint records results to the -checkpoint file as they complete.
+type checkpoint struct {
+	f *os.File
+}
+
+// openCheckpoint opens the checkpoint file at path, truncating it unless
+// resume is set, in which case the results already in it are returned by
+// target.
+func openCheckpoint(path string, resume bool) (*checkpoint, map[string]checkpointEntry, error) {
+	var done map[string]checkpointEntry
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		var err error
+		done, err = readCheckpoint(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &checkpoint{f: f}, done, nil
+}
+
+func readCheckpoint(path string) (map[string]checkpointEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(map[string]checkpointEntry)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var e checkpointEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		out[e.Target] = e
+	}
+	return out, sc.Err()
+}
+
+// record appends the result i for t. Skipped items and those abandoned at
+// -deadline are not recorded, so that they are checked again on resume.
+func (c *checkpoint) record(t target, i Item, now time.Time) error {
+	if i.skipped || i.err == errTimedOut {
+		return nil
+	}
+	b, err := json.Marshal(newCheckpointEntry(cacheKey(t), i, now))
+	if err != nil {
+		return err
+	}
+	_, err = c.f.Write(append(b, '\n'))
+	return err
+}
+
+// newCheckpointEntry returns the entry for the result i, checked at now, of
+// the target named target.
+func newCheckpointEntry(target string, i Item, now time.Time) checkpointEntry {
+	return checkpointEntry{
+		Target:    target,
+		CheckedAt: now.UTC().Format(time.RFC3339),
+		jsonItem:  i.jsonItem(now),
+
+		PinMismatch: i.pinMismatch,
+		SANs:        i.sans,
+	}
+}
+
+func (c *checkpoint) Close() error {
+	return c.f.Close()
+}
+
+// item returns the Item recorded in e for t, with a detail noting that it
+// is from source, such as "the checkpoint".
+func (e checkpointEntry) item(t target, source string) Item {
+	i := Item{
+		domain:      e.Domain,
+		findings:    e.Findings,
+		fingerprint: e.Fingerprint,
+		chainLength: e.ChainLength,
+		threshold:   t.threshold,
+		details:     []string{"from " + source + ", checked " + e.CheckedAt},
+		pinMismatch: e.PinMismatch,
+		sans:        e.SANs,
+	}
+	if e.Error != "" {
+		i.err = errors.New(e.Error)
+		return i
+	}
+	i.notBefore, _ = time.Parse(time.RFC3339, e.NotBefore)
+	i.notAfter, _ = time.Parse(time.RFC3339, e.NotAfter)
+	return i
+}
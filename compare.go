@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// previous, if non-nil, holds the entries of the -compare-to report by
+// domain.
+var previous map[string]jsonItem
+
+// loadPrevious reads a report written with -format ndjson.
+func loadPrevious(path string) (map[string]jsonItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(map[string]jsonItem)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var j jsonItem
+		if err := json.Unmarshal([]byte(line), &j); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		out[j.Domain] = j
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// replacedFinding begins the finding added by compare for a replaced cert.
+const replacedFinding = "cert replaced since the previous report"
+
+// compare annotates i with the changes since the previous report: how its
+// days remaining changed, and whether its cert was replaced.
+func compare(i Item, now time.Time) Item {
+	prev, ok := previous[i.domain]
+	if !ok || i.err != nil || prev.Fingerprint == "" || prev.DaysRemaining == nil {
+		return i
+	}
+	days := daysRemaining(i.notAfter, now)
+	i.details = append(i.details, fmt.Sprintf("%d days remaining, %+d since the previous report", days, days-*prev.DaysRemaining))
+	if prev.Fingerprint != i.fingerprint {
+		f := replacedFinding
+		if t, err := time.Parse(time.RFC3339, prev.NotAfter); err == nil {
+			f += ", from one expiring " + formatTime(t)
+		}
+		i.findings = append(i.findings, f)
+	}
+	return i
+}
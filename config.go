@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// domainsHeader separates the settings from the domains in a combined
+// configuration file.
+const domainsHeader = "[domains]"
+
+// loadConfig reads the settings of the combined configuration file at path.
+// A configuration file has a settings section followed by a domains
+// section:
+//
+//	# comment
+//	recipient admin@example.org
+//	max-validity 398
+//
+//	[domains]
+//	example.org
+//	www.example.org
+//
+// Each setting is a flag name and its value; boolean flags may omit the
+// value. Flags given on the command line take precedence over settings in
+// the file. The "recipient" setting is used if no recipient argument is
+// given. The domains section has the same format as standard input, and is
+// read by configDomains, after -pre-hook has run.
+func loadConfig(path string) (recipient string, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == domainsHeader {
+			break
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		if name == "recipient" {
+			recipient = value
+			continue
+		}
+		if set[name] {
+			continue
+		}
+		f := flag.Lookup(name)
+		if f == nil || name == "c" {
+			return "", fmt.Errorf("%s:%d: unknown setting %q", path, n, name)
+		}
+		if value == "" && isBoolFlag(f) {
+			value = "true"
+		}
+		if err := f.Value.Set(value); err != nil {
+			return "", fmt.Errorf("%s:%d: %s: %s", path, n, name, err)
+		}
+	}
+	return recipient, scanner.Err()
+}
+
+// configDomains reads the domains section of the combined configuration file
+// at path.
+func configDomains(path string) ([]target, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// the lines up to the header are left blank, so that the lines of the
+	// domains section keep their numbers in the file.
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	var rest bytes.Buffer
+	for scanner.Scan() {
+		rest.WriteByte('\n')
+		if strings.TrimSpace(scanner.Text()) == domainsHeader {
+			break
+		}
+	}
+	for scanner.Scan() {
+		rest.Write(scanner.Bytes())
+		rest.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return domains(&rest, path)
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
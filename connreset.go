@@ -0,0 +1,14 @@
+//go:build !plan9
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isConnReset reports whether err was caused by the peer resetting the
+// connection.
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
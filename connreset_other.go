@@ -0,0 +1,10 @@
+//go:build plan9
+
+package main
+
+// isConnReset reports whether err was caused by the peer resetting the
+// connection. Plan 9 has no errno for it, so a reset is reported as other
+// handshake failures are.
+func isConnReset(err error) bool {
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ctSearchURL is the crt.sh endpoint queried with -check-ct.
+const ctSearchURL = "https://crt.sh/"
+
+// ctTimeout bounds a -check-ct query. crt.sh is often slow.
+const ctTimeout = 20 * time.Second
+
+// maxCTListed is the number of unexpected certs described in a finding.
+const maxCTListed = 3
+
+// A ctEntry is a cert in the crt.sh JSON output.
+type ctEntry struct {
+	IssuerName   string `json:"issuer_name"`
+	NotBefore    string `json:"not_before"` // UTC, without a zone
+	NotAfter     string `json:"not_after"`
+	SerialNumber string `json:"serial_number"` // hex
+}
+
+const ctTimeLayout = "2006-01-02T15:04:05"
+
+// checkCT queries the CT logs, via crt.sh, for the unexpired certs issued
+// for host and returns a finding describing those other than leaf, if any.
+// A failed query is returned as a detail instead, since it says nothing
+// about the domain.
+func checkCT(ctx context.Context, host string, leaf *x509.Certificate) (finding, detail string) {
+	entries, err := queryCT(ctx, host)
+	if err != nil {
+		return "", fmt.Sprintf("CT logs not checked: %v", err)
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	var others []string
+	for _, e := range entries {
+		serial, ok := new(big.Int).SetString(e.SerialNumber, 16)
+		if !ok || serial.Cmp(leaf.SerialNumber) == 0 || seen[e.SerialNumber] {
+			continue
+		}
+		notAfter, err := time.Parse(ctTimeLayout, e.NotAfter)
+		if err != nil || notAfter.Before(now) {
+			continue
+		}
+		seen[e.SerialNumber] = true // precerts and certs share a serial
+		desc := fmt.Sprintf("serial %s from %q", e.SerialNumber, e.IssuerName)
+		if notBefore, err := time.Parse(ctTimeLayout, e.NotBefore); err == nil {
+			desc += ", valid from " + formatTime(notBefore)
+		}
+		others = append(others, desc)
+	}
+	if len(others) == 0 {
+		return "", "CT logs list no other unexpired certs"
+	}
+	n := int64(len(others))
+	if len(others) > maxCTListed {
+		others = append(others[:maxCTListed], fmt.Sprintf("and %d more", len(others)-maxCTListed))
+	}
+	return fmt.Sprintf("CT logs list %d other unexpired %s: %s", n, pluralize(n, "cert"), strings.Join(others, ", ")), ""
+}
+
+func queryCT(ctx context.Context, host string) ([]ctEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, ctTimeout)
+	defer cancel()
+
+	q := url.Values{"q": {host}, "output": {"json"}, "exclude": {"expired"}}
+	req, err := http.NewRequestWithContext(ctx, "GET", ctSearchURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", ctSearchURL, resp.Status)
+	}
+	var entries []ctEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", ctSearchURL, err)
+	}
+	return entries, nil
+}
+
+// ctHost returns the name to look up in the CT logs for t, or "" if t has
+// no DNS name.
+func ctHost(t target) string {
+	h := strings.TrimSuffix(t.hostname(), ".")
+	if h == "" || net.ParseIP(h) != nil {
+		return ""
+	}
+	return h
+}
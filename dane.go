@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// resolvConf lists the DNS servers queried for TLSA records with
+// -check-dane. The standard library resolver cannot look up TLSA records,
+// so they are queried directly.
+const resolvConf = "/etc/resolv.conf"
+
+// daneTimeout bounds the TLSA lookup for a domain.
+const daneTimeout = 5 * time.Second
+
+const (
+	dnsTypeTLSA = 52
+	dnsTypeOPT  = 41
+	dnsClassIN  = 1
+
+	dnsFlagRD = 0x0100 // recursion desired
+	dnsFlagTC = 0x0200 // truncated
+	dnsFlagAD = 0x0020 // authenticated data, i.e. DNSSEC-validated by the resolver
+	dnsFlagQR = 0x8000 // response
+
+	dnsRcodeNXDomain = 3
+
+	dnsUDPSize = 4096 // advertised with EDNS(0); TLSA records holding full certs exceed 512 bytes
+)
+
+// A tlsaRecord is a TLSA resource record (RFC 6698).
+type tlsaRecord struct {
+	usage        uint8 // 0 PKIX-TA, 1 PKIX-EE, 2 DANE-TA, 3 DANE-EE
+	selector     uint8 // 0 full cert, 1 SubjectPublicKeyInfo
+	matchingType uint8 // 0 exact, 1 SHA-256, 2 SHA-512
+	data         []byte
+}
+
+// checkDANE looks up the TLSA records for t and returns a finding if the
+// cert chain in cs matches none of them. As with checkCT, a failed lookup,
+// or the absence of records, is returned as a detail instead.
+func checkDANE(ctx context.Context, t target, cs *tls.ConnectionState) (finding, detail string) {
+	_, port := t.hostPort()
+	name := fmt.Sprintf("_%s._tcp.%s", port, ctHost(t))
+
+	records, validated, err := lookupTLSA(ctx, name)
+	if err != nil {
+		return "", fmt.Sprintf("TLSA records not checked: %v", err)
+	}
+	var usable []tlsaRecord
+	for _, r := range records {
+		if r.usage <= 3 && r.selector <= 1 && r.matchingType <= 2 {
+			usable = append(usable, r)
+		}
+	}
+	if len(usable) == 0 {
+		return "", "no usable TLSA records at " + name
+	}
+
+	var note string
+	if !validated {
+		note = ", not DNSSEC-validated by the resolver"
+	}
+	for _, r := range usable {
+		if r.matches(cs) {
+			return "", fmt.Sprintf("cert matches a TLSA record at %s (usage %d, selector %d, matching type %d)%s", name, r.usage, r.selector, r.matchingType, note)
+		}
+	}
+	if len(usable) == 1 {
+		return fmt.Sprintf("cert does not match the TLSA record at %s%s", name, note), ""
+	}
+	return fmt.Sprintf("cert matches none of the %d TLSA records at %s%s", len(usable), name, note), ""
+}
+
+// matches reports whether r matches the leaf cert in cs or, for the
+// trust anchor usages, one of the other certs presented or in a verified
+// chain.
+func (r tlsaRecord) matches(cs *tls.ConnectionState) bool {
+	leaf := cs.PeerCertificates[0]
+	if r.usage == 1 || r.usage == 3 {
+		return r.matchesCert(leaf)
+	}
+	anchors := append([]*x509.Certificate(nil), cs.PeerCertificates[1:]...)
+	for _, chain := range cs.VerifiedChains {
+		anchors = append(anchors, chain[1:]...)
+	}
+	for _, c := range anchors {
+		if r.matchesCert(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r tlsaRecord) matchesCert(c *x509.Certificate) bool {
+	data := c.Raw
+	if r.selector == 1 {
+		data = c.RawSubjectPublicKeyInfo
+	}
+	switch r.matchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, r.data)
+}
+
+// lookupTLSA queries the servers in resolvConf, in turn, for the TLSA
+// records at name. validated reports whether the resolver claimed to have
+// validated the answer with DNSSEC.
+func lookupTLSA(ctx context.Context, name string) (records []tlsaRecord, validated bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, daneTimeout)
+	defer cancel()
+
+	query, id, err := tlsaQuery(name)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, server := range nameservers() {
+		var resp []byte
+		resp, err = exchangeDNS(ctx, "udp", server, query)
+		if err == nil && len(resp) >= 4 && binary.BigEndian.Uint16(resp[2:])&dnsFlagTC != 0 {
+			resp, err = exchangeDNS(ctx, "tcp", server, query)
+		}
+		if err != nil {
+			continue
+		}
+		records, validated, err = parseTLSAResponse(resp, id)
+		if err == nil {
+			return records, validated, nil
+		}
+	}
+	return nil, false, err
+}
+
+// nameservers returns the host:port of the DNS servers in resolvConf,
+// falling back, as the standard library does, to the local host.
+func nameservers() []string {
+	var servers []string
+	if f, err := os.Open(resolvConf); err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	return servers
+}
+
+// tlsaQuery returns a DNS query for the TLSA records at name and its ID.
+func tlsaQuery(name string) ([]byte, uint16, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(b[:])
+
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, dnsFlagRD|dnsFlagAD)
+	msg = append(msg, 0, 1, 0, 0, 0, 0, 0, 1) // one question, one additional record
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid DNS name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeTLSA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	// EDNS(0) OPT record: root name, type, UDP size, no extended flags or
+	// options.
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, dnsUDPSize)
+	msg = append(msg, 0, 0, 0, 0, 0, 0)
+	return msg, id, nil
+}
+
+// exchangeDNS sends query to server over network, which is "udp" or "tcp",
+// and returns the response.
+func exchangeDNS(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, dnsUDPSize)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[:n], nil
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+var errShortDNSResponse = errors.New("malformed DNS response")
+
+// parseTLSAResponse returns the TLSA records in the answer section of the
+// DNS response resp to the query with the given id. A name that does not
+// exist has no records.
+func parseTLSAResponse(resp []byte, id uint16) (records []tlsaRecord, validated bool, err error) {
+	if len(resp) < 12 {
+		return nil, false, errShortDNSResponse
+	}
+	flags := binary.BigEndian.Uint16(resp[2:])
+	if binary.BigEndian.Uint16(resp) != id || flags&dnsFlagQR == 0 {
+		return nil, false, errors.New("unexpected DNS response")
+	}
+	switch rcode := flags & 0xf; rcode {
+	case 0:
+	case dnsRcodeNXDomain:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("DNS query failed with rcode %d", rcode)
+	}
+	qdcount := binary.BigEndian.Uint16(resp[4:])
+	ancount := binary.BigEndian.Uint16(resp[6:])
+
+	off := 12
+	for k := 0; k < int(qdcount); k++ {
+		if off, err = skipDNSName(resp, off); err != nil {
+			return nil, false, err
+		}
+		off += 4 // type and class
+	}
+	for k := 0; k < int(ancount); k++ {
+		if off, err = skipDNSName(resp, off); err != nil {
+			return nil, false, err
+		}
+		if off+10 > len(resp) {
+			return nil, false, errShortDNSResponse
+		}
+		typ := binary.BigEndian.Uint16(resp[off:])
+		rdlen := int(binary.BigEndian.Uint16(resp[off+8:]))
+		off += 10
+		if off+rdlen > len(resp) {
+			return nil, false, errShortDNSResponse
+		}
+		if rdata := resp[off : off+rdlen]; typ == dnsTypeTLSA && len(rdata) > 3 {
+			records = append(records, tlsaRecord{
+				usage:        rdata[0],
+				selector:     rdata[1],
+				matchingType: rdata[2],
+				data:         rdata[3:],
+			})
+		}
+		off += rdlen
+	}
+	return records, flags&dnsFlagAD != 0, nil
+}
+
+// skipDNSName returns the offset in msg just past the possibly compressed
+// name at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errShortDNSResponse
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			return off + 2, nil // pointer
+		default:
+			off += 1 + l
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// A distrust is an entry of the -distrust file: a CA that browsers stop
+// trusting on a date.
+type distrust struct {
+	ca   string    // the CA's name, or the hex-encoded SHA-256 fingerprint of its cert
+	date time.Time // UTC
+}
+
+// distrusts lists the CAs from -distrust.
+var distrusts []distrust
+
+// loadDistrust reads a -distrust file: lines of a date, as YYYY-MM-DD, and
+// either the name of a CA, as in the common name or organization of
+// issuers, or the SHA-256 fingerprint of a CA cert, optionally with colons
+// between bytes. Blank lines and lines starting with "#" are ignored.
+func loadDistrust(path string) ([]distrust, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []distrust
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		date, ca, _ := strings.Cut(line, " ")
+		ca = strings.TrimSpace(ca)
+		if ca == "" {
+			return nil, fmt.Errorf("%s:%d: want a date and a CA", path, n)
+		}
+		d, err := time.Parse(dateLayout, date)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid date %q, want YYYY-MM-DD", path, n, date)
+		}
+		if fp := strings.ToLower(strings.ReplaceAll(ca, ":", "")); len(fp) == 64 {
+			if _, err := hex.DecodeString(fp); err == nil {
+				ca = fp
+			}
+		}
+		out = append(out, distrust{ca: ca, date: d})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// distrusted returns the entry of -distrust for the earliest distrust that
+// affects chain, whose leaf is first: one of a CA in the chain, or the
+// issuer of a cert in it, that occurs before the leaf expires.
+func distrusted(chain []*x509.Certificate) (distrust, bool) {
+	leaf := chain[0]
+	var found distrust
+	for _, d := range distrusts {
+		if !d.date.Before(leaf.NotAfter) || (!found.date.IsZero() && !d.date.Before(found.date)) {
+			continue
+		}
+		if issuedBy(chain, d.ca) {
+			found = d
+		}
+	}
+	return found, !found.date.IsZero()
+}
+
+// String returns the CA of d as shown in findings.
+func (d distrust) String() string {
+	if _, err := hex.DecodeString(d.ca); err == nil && len(d.ca) == 64 {
+		return "the CA with fingerprint " + d.ca[:16]
+	}
+	return d.ca
+}
+
+// issuedBy reports whether ca, as given in a -distrust file, is a CA cert
+// presented after the leaf of chain, or the issuer of a cert in chain.
+func issuedBy(chain []*x509.Certificate, ca string) bool {
+	for k, c := range chain {
+		if k != 0 && fingerprint(c) == ca {
+			return true
+		}
+		if c.Issuer.CommonName == ca {
+			return true
+		}
+		for _, o := range c.Issuer.Organization {
+			if o == ca {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostCache caches the results of host lookups for a limited time, so that
+// names that appear repeatedly are resolved once. Concurrent lookups of the
+// same name share a single query.
+type hostCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*hostEntry
+}
+
+type hostEntry struct {
+	done    chan struct{} // closed once addrs and err are set
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+func newHostCache(ttl time.Duration) *hostCache {
+	return &hostCache{
+		ttl:     ttl,
+		entries: make(map[string]*hostEntry),
+	}
+}
+
+func (c *hostCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	if !ok || e.stale(time.Now()) {
+		e = &hostEntry{done: make(chan struct{})}
+		c.entries[host] = e
+		c.mu.Unlock()
+
+		e.addrs, e.err = net.DefaultResolver.LookupHost(ctx, host)
+		e.expires = time.Now().Add(c.ttl)
+		if e.err != nil {
+			e.expires = time.Time{} // don't cache failures
+		}
+		close(e.done)
+		return e.addrs, e.err
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return e.addrs, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stale reports whether e is a completed lookup whose result has expired.
+// Must be called with the cache's mutex held.
+func (e *hostEntry) stale(now time.Time) bool {
+	select {
+	case <-e.done:
+		return !now.Before(e.expires)
+	default:
+		return false // in flight
+	}
+}
+
+// dialer is the interface common to net.Dialer and tls.Dialer.
+type dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dialHost connects to host:port using d. If hosts is non-nil, host is
+// resolved through it and each of its addresses is tried in turn.
+func dialHost(ctx context.Context, d dialer, hosts *hostCache, host, port string) (net.Conn, error) {
+	if hosts == nil {
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+	addrs, err := hosts.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, a := range addrs {
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// lookupHost resolves host, through the hosts cache if there is one.
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	if hosts != nil {
+		return hosts.lookup(ctx, host)
+	}
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+// A resolution is the result of resolving the host of a target.
+type resolution struct {
+	addrs []string
+	err   error
+}
+
+// resolveAll resolves the host of each of ts concurrently, for -resolve-only.
+// Unix socket targets and targets whose host is an IP address need no lookup
+// and resolve to nothing.
+func resolveAll(ctx context.Context, ts []target) []resolution {
+	out := make([]resolution, len(ts))
+	var wg sync.WaitGroup
+	for i := range ts {
+		if _, ok := ts[i].unixPath(); ok {
+			continue
+		}
+		host, _ := ts[i].hostPort()
+		if net.ParseIP(host) != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, host string) {
+			defer wg.Done()
+			out[idx].addrs, out[idx].err = lookupHost(ctx, host)
+		}(i, host)
+	}
+	wg.Wait()
+	return out
+}
+
+// expandIPs returns ts with each target replaced by one target per address
+// its host resolves to. Unix socket targets, targets whose host is an IP
+// address, and targets whose host fails to resolve are left as is, so that
+// a failure is reported when the target is checked.
+func expandIPs(ctx context.Context, ts []target) []target {
+	addrs := make([][]string, len(ts))
+	var wg sync.WaitGroup
+	for i := range ts {
+		if _, ok := ts[i].unixPath(); ok {
+			continue
+		}
+		host, _ := ts[i].hostPort()
+		if net.ParseIP(host) != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, host string) {
+			defer wg.Done()
+			var err error
+			addrs[idx], err = lookupHost(ctx, host)
+			if err != nil {
+				addrs[idx] = nil
+			}
+		}(i, host)
+	}
+	wg.Wait()
+
+	var out []target
+	for i, t := range ts {
+		if len(addrs[i]) == 0 {
+			out = append(out, t)
+			continue
+		}
+		for _, a := range addrs[i] {
+			t.ip = a
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// markInconsistent adds a finding to each of items, the results for the
+// -all-ips expansion ts, whose host is served different certs by different
+// addresses, as during an incomplete rotation.
+func markInconsistent(ts []target, items []Item, now time.Time) {
+	groups := make(map[string][]int)
+	for k, t := range ts {
+		if t.ip == "" || items[k].err != nil {
+			continue
+		}
+		groups[t.domain] = append(groups[t.domain], k)
+	}
+	for _, g := range groups {
+		consistent := true
+		for _, k := range g[1:] {
+			if items[k].fingerprint != items[g[0]].fingerprint {
+				consistent = false
+			}
+		}
+		if consistent {
+			continue
+		}
+		var backends []string
+		for _, k := range g {
+			backends = append(backends, fmt.Sprintf("%s %s", ts[k].ip, expiryInfo(items[k].notAfter, now)))
+		}
+		f := "inconsistent certs across backends: " + strings.Join(backends, ", ")
+		for _, k := range g {
+			items[k].findings = append(items[k].findings, f)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// runHook runs command with sh(1), passing stdin on its standard input and
+// args as the positional parameters. The command's output goes to standard
+// error so that it does not mix with the report.
+func runHook(name, command, stdin string, args ...string) error {
+	cmd := exec.Command("sh", append([]string{"-c", command, "sh"}, args...)...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+// runRenewalHook runs -renewal-hook for each of items, the results for ts,
+// whose cert expires soon, with the domain as $1 and on standard input. It
+// runs once per domain, even if several targets share it, as with -all-ips.
+// A failure is added to the findings of each item for the domain and does
+// not stop the others.
+func runRenewalHook(ts []target, items []Item, now time.Time) {
+	ran := make(map[string]error)
+	for k, i := range items {
+		if i.err != nil || !i.expiresSoon(now) {
+			continue
+		}
+		host := ts[k].hostname()
+		if host == "" {
+			continue
+		}
+		err, ok := ran[host]
+		if !ok {
+			err = runHook("-renewal-hook", fRenewalHook, host+"\n", host)
+			ran[host] = err
+		}
+		if err != nil {
+			items[k].findings = append(items[k].findings, err.Error())
+		}
+	}
+}
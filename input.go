@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A target is an entry in the domains list.
+//
+// Each line of the list is a domain, with an optional ":<port>" suffix for
+// ports other than 443, optionally followed by space-separated
+// key=value annotations:
+//
+//	servername=<name>   use <name> for SNI instead of the domain
+//	warn=<n>d           notify when the cert expires within n days
+//
+// A URL such as "https://example.com:8443/health" is checked at its host and
+// port; URLs with other schemes are skipped with a warning.
+//
+// A CIDR block such as "192.168.1.0/24:443" is expanded to each host address
+// in the block, which are checked without SNI.
+//
+// A domain of the form "unix:<path>" is checked by performing the TLS
+// handshake over the unix socket at <path>; such entries usually need a
+// servername annotation.
+type target struct {
+	domain     string // as written in the input
+	serverName string // empty means derived from domain
+	ip         string // address to dial instead of resolving the host (-all-ips, hosts input)
+	threshold  time.Duration
+}
+
+// hostname returns the name to send for SNI and to expect in the cert, or
+// the empty string if there is none.
+func (t target) hostname() string {
+	if t.serverName != "" {
+		return t.serverName
+	}
+	if _, ok := t.unixPath(); ok {
+		return ""
+	}
+	host, _ := t.hostPort()
+	return host
+}
+
+// hostPort returns the host and port to dial for t.
+func (t target) hostPort() (host, port string) {
+	if h, p, err := net.SplitHostPort(t.domain); err == nil {
+		return h, p
+	}
+	return t.domain, "443"
+}
+
+// displayName returns the name used for t in output.
+func (t target) displayName() string {
+	name := t.domain
+	if _, ok := t.unixPath(); !ok && fStripPort {
+		name, _ = t.hostPort()
+	}
+	if t.ip != "" {
+		name += " (" + t.ip + ")"
+	}
+	return name
+}
+
+// unixPath returns the socket path if t is a "unix:<path>" entry.
+func (t target) unixPath() (string, bool) {
+	const prefix = "unix:"
+	if !strings.HasPrefix(t.domain, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(t.domain, prefix), true
+}
+
+// domains parses the domains list in r, which is either text, as described
+// for target, or a JSON inventory, according to -input-format. Lines are
+// named in errors and warnings as lines of the file name, if given.
+func domains(r io.Reader, name string) ([]target, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case fInputFormat.value == "json" || fInputFormat.value == "auto" && looksLikeJSON(b):
+		ts, err := inventoryDomains(b)
+		if err != nil && name != "" {
+			err = fmt.Errorf("%s: %s", name, err)
+		}
+		return ts, err
+	case fInputFormat.value == "hosts":
+		return hostsDomains(bytes.NewReader(b), name)
+	}
+	return textDomains(bytes.NewReader(b), name)
+}
+
+// lineLabel names line n of the file name, or of the list if name is "".
+func lineLabel(name string, n int) string {
+	if name == "" {
+		return fmt.Sprintf("line %d", n)
+	}
+	return fmt.Sprintf("%s:%d", name, n)
+}
+
+// textDomains parses a list of targets, one per line. Lines that are blank,
+// including after expansion, and lines starting with "#" are skipped.
+func textDomains(r io.Reader, name string) ([]target, error) {
+	scanner := bufio.NewScanner(r)
+	var out []target
+	for n := 1; scanner.Scan(); n++ {
+		if strings.HasPrefix(strings.TrimSpace(scanner.Text()), "#") {
+			continue
+		}
+		line, err := expandEnv(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", lineLabel(name, n), err)
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		t, ok, err := parseTarget(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", lineLabel(name, n), err)
+		}
+		if !ok {
+			log.Printf("warning: %s: skipping non-https URL", lineLabel(name, n))
+			continue
+		}
+		if ts, ok, err := cidrTargets(t); ok {
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", lineLabel(name, n), err)
+			}
+			out = append(out, ts...)
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, scanner.Err()
+}
+
+// hostsDomains parses a list in hosts(5) format, for -input-format hosts:
+// lines of an IP address followed by host names, with comments starting at
+// "#". Each name is a target dialed at the address on the line.
+func hostsDomains(r io.Reader, name string) ([]target, error) {
+	scanner := bufio.NewScanner(r)
+	var out []target
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("%s: invalid IP address %q", lineLabel(name, n), fields[0])
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("%s: no host names", lineLabel(name, n))
+		}
+		for _, host := range fields[1:] {
+			out = append(out, target{domain: host, ip: ip.String()})
+		}
+	}
+	return out, scanner.Err()
+}
+
+// maxSANTargets bounds the number of targets added by -expand-sans.
+const maxSANTargets = 1000
+
+// sanTargets returns targets for the DNS names in the SANs of items, the
+// results for ts, that are not already among ts, at the same port as the
+// target whose cert listed them, or 443 for a unix socket. Wildcard names are
+// skipped. The names found are not expanded in turn, so the expansion
+// ends.
+func sanTargets(ts []target, items []Item) []target {
+	seen := make(map[string]bool)
+	for _, t := range ts {
+		seen[normalizeHost(t.hostname())] = true
+	}
+	var out []target
+	for k, i := range items {
+		port := "443"
+		if _, ok := ts[k].unixPath(); !ok {
+			_, port = ts[k].hostPort()
+		}
+		for _, name := range i.sans {
+			name = strings.ToLower(name)
+			if strings.HasPrefix(name, "*.") || seen[normalizeHost(name)] {
+				continue
+			}
+			seen[normalizeHost(name)] = true
+			if len(out) == maxSANTargets {
+				log.Printf("warning: -expand-sans: checking only the first %d names", maxSANTargets)
+				return out
+			}
+			d := name
+			if port != "443" {
+				d = net.JoinHostPort(name, port)
+			}
+			out = append(out, target{domain: d})
+		}
+	}
+	return out
+}
+
+// commandDomains runs command with sh(1) and parses its output as with
+// domains.
+func commandDomains(command string) ([]target, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("-domains-cmd: %s", err)
+	}
+	ts, err := domains(bytes.NewReader(out), "")
+	if err != nil {
+		return nil, fmt.Errorf("-domains-cmd: %s", err)
+	}
+	return ts, nil
+}
+
+// parseTarget parses a line of the domains list. It returns false if the
+// line is a URL that should be skipped.
+func parseTarget(line string) (target, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return target{}, true, nil
+	}
+	domain, ok, err := urlDomain(fields[0])
+	if !ok || err != nil {
+		return target{}, false, err
+	}
+	t := target{domain: domain}
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return target{}, false, fmt.Errorf("malformed annotation %q", f)
+		}
+		switch k {
+		case "servername":
+			t.serverName = v
+		case "warn":
+			d, err := parseDays(v)
+			if err != nil {
+				return target{}, false, fmt.Errorf("warn: %s", err)
+			}
+			t.threshold = d
+		default:
+			return target{}, false, fmt.Errorf("unknown annotation %q", k)
+		}
+	}
+	return t, true, nil
+}
+
+// urlDomain returns the host and port of s if it is an https URL, or else s.
+// It returns false if s is a URL that should be skipped.
+func urlDomain(s string) (string, bool, error) {
+	if !strings.Contains(s, "://") {
+		return s, true, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", false, err
+	}
+	if u.Scheme != "https" {
+		return "", false, nil
+	}
+	return u.Host, true, nil
+}
+
+// maxCIDRHosts bounds the number of addresses a CIDR block may expand to.
+const maxCIDRHosts = 4096
+
+// cidrTargets returns one target per host address if t is a CIDR block. It
+// returns false if t is not a CIDR block.
+func cidrTargets(t target) ([]target, bool, error) {
+	host, port := t.hostPort()
+	if !strings.Contains(host, "/") {
+		return nil, false, nil
+	}
+	p, err := netip.ParsePrefix(host)
+	if err != nil {
+		return nil, true, err
+	}
+	p = p.Masked()
+	hostBits := p.Addr().BitLen() - p.Bits()
+	if hostBits >= 64 || uint64(1)<<hostBits > maxCIDRHosts { // uint64, since int may be 32 bits
+		return nil, true, fmt.Errorf("%s has more than %d addresses", p, maxCIDRHosts)
+	}
+
+	first, last := p.Addr(), lastAddr(p)
+	if p.Addr().Is4() && hostBits >= 2 {
+		// skip the network and broadcast addresses.
+		first, last = first.Next(), last.Prev()
+	}
+	var out []target
+	for a := first; a.IsValid() && a.Compare(last) <= 0; a = a.Next() {
+		c := t
+		c.domain = net.JoinHostPort(a.String(), port)
+		out = append(out, c)
+	}
+	return out, true, nil
+}
+
+// lastAddr returns the last address in the masked prefix p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// parseDays parses a positive number of days written as "<n>d".
+func parseDays(s string) (time.Duration, error) {
+	n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+	if err != nil || !strings.HasSuffix(s, "d") || n <= 0 {
+		return 0, fmt.Errorf("invalid number of days %q", s)
+	}
+	return time.Duration(n) * 24 * time.Hour, nil
+}
+
+// expandEnv replaces ${var} or $var in s with the value of the environment
+// variable. Unset variables are an error unless -allow-unset-env is set, in
+// which case they expand to the empty string with a warning.
+func expandEnv(s string) (string, error) {
+	var unset []string
+	out := os.Expand(s, func(k string) string {
+		v, ok := os.LookupEnv(k)
+		if !ok {
+			unset = append(unset, k)
+		}
+		return v
+	})
+	if len(unset) == 0 {
+		return out, nil
+	}
+	if !fAllowUnset {
+		return "", fmt.Errorf("environment variable %s is not set", unset[0])
+	}
+	for _, k := range unset {
+		log.Printf("warning: environment variable %s is not set", k)
+	}
+	return out, nil
+}
+
+// dedupDomains returns ts without the targets whose domain, as normalized
+// by normalizeDomain, and address are the same as those of an earlier
+// target.
+func dedupDomains(ts []target) []target {
+	seen := make(map[string]bool)
+	var out []target
+	for _, t := range ts {
+		k := normalizeDomain(t.domain) + " " + t.ip
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, t)
+	}
+	return out
+}
+
+// normalizeDomain returns domain, as written in the input, in the form in
+// which it is compared with other domains for duplicates, -only, and
+// -pins. With -normalize www, its host is normalized by normalizeHost and
+// the default port is dropped, so that www.example.com and
+// example.com:443 compare equal. Otherwise domain is unchanged.
+func normalizeDomain(domain string) string {
+	if fNormalize.value == "none" || strings.HasPrefix(domain, "unix:") {
+		return domain
+	}
+	if h, p, err := net.SplitHostPort(domain); err == nil {
+		if p == "443" {
+			return normalizeHost(h)
+		}
+		return net.JoinHostPort(normalizeHost(h), p)
+	}
+	return normalizeHost(domain)
+}
+
+// normalizeHost returns host lower-cased and without a trailing dot, and,
+// with -normalize www, without a leading "www." label. A name that would be
+// left with a single label, such as www.com, keeps the label.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if fNormalize.value == "www" {
+		if rest := strings.TrimPrefix(host, "www."); strings.Contains(rest, ".") {
+			return rest
+		}
+	}
+	return host
+}
+
+// onlyDomains returns the targets in ts whose domains are named in only,
+// preserving the input order. It is an error for a name in only to be absent
+// from ts.
+func onlyDomains(ts []target, only []string) ([]target, error) {
+	want := make(map[string]bool, len(only))
+	for _, o := range only {
+		want[normalizeDomain(o)] = true
+	}
+	found := make(map[string]bool, len(only))
+	var out []target
+	for _, t := range ts {
+		if d := normalizeDomain(t.domain); want[d] {
+			out = append(out, t)
+			found[d] = true
+		}
+	}
+	for _, o := range only {
+		if !found[normalizeDomain(o)] {
+			return nil, fmt.Errorf("-only: %s not found in input", o)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// inspect returns the problems with the connection's leaf cert, other than
+// its expiry, that should be reported.
+func inspect(t target, cs tls.ConnectionState) []string {
+	cert := cs.PeerCertificates[0]
+	var out []string
+	if fMaxValidity > 0 {
+		validity := cert.NotAfter.Sub(cert.NotBefore)
+		if validity > time.Duration(fMaxValidity)*24*time.Hour {
+			n := int64(validity / (24 * time.Hour))
+			out = append(out, fmt.Sprintf("validity period of %d %s exceeds %d days", n, pluralize(n, "day"), fMaxValidity))
+		}
+	}
+	if d, ok := distrusted(cs.PeerCertificates); ok {
+		if time.Now().Before(d.date) {
+			out = append(out, fmt.Sprintf("issued by %s, which is distrusted from %s, before the cert expires; reissue from another CA", d, d.date.Format(dateLayout)))
+		} else {
+			out = append(out, fmt.Sprintf("issued by %s, which has been distrusted since %s", d, d.date.Format(dateLayout)))
+		}
+	}
+	if fMaxSANs > 0 && len(cert.DNSNames) > fMaxSANs {
+		out = append(out, fmt.Sprintf("lists %d DNS names, more than %d, suggesting a shared cert", len(cert.DNSNames), fMaxSANs))
+	}
+	if !fFreezeStart.t.IsZero() {
+		// the freeze includes the whole of its last day.
+		if !cert.NotAfter.Before(fFreezeStart.t) && cert.NotAfter.Before(fFreezeEnd.t.AddDate(0, 0, 1)) {
+			out = append(out, fmt.Sprintf("expires during freeze, %s to %s", fFreezeStart.String(), fFreezeEnd.String()))
+		}
+	}
+	if !serverAuth(cert) {
+		out = append(out, "cert extended key usage does not permit server authentication")
+	}
+	if mustStaple(cert) && len(cs.OCSPResponse) == 0 {
+		out = append(out, "must-staple cert but no stapled OCSP response")
+	}
+	if len(cs.OCSPResponse) > 0 {
+		s, err := parseStaple(cs.OCSPResponse, cert)
+		switch {
+		case err != nil:
+			out = append(out, fmt.Sprintf("unusable stapled OCSP response: %v", err))
+		case s.revoked:
+			out = append(out, "stapled OCSP response reports the cert revoked")
+		case s.nextUpdate.IsZero():
+		case time.Now().After(s.nextUpdate):
+			out = append(out, fmt.Sprintf("stapled OCSP response went stale %s", formatTime(s.nextUpdate)))
+		case time.Until(s.nextUpdate) < ocspStaleThreshold:
+			out = append(out, fmt.Sprintf("stapled OCSP response goes stale %s", formatTime(s.nextUpdate)))
+		}
+	}
+	if fWarnMissingSAN {
+		if h := t.hostname(); h != "" && !hasSAN(cert, h) {
+			out = append(out, fmt.Sprintf("%s not listed in cert SANs", h))
+		}
+	}
+	if fFlagWildcards {
+		if h := t.hostname(); h != "" && !hasSAN(cert, h) {
+			if w := wildcardSAN(cert, h); w != "" {
+				out = append(out, fmt.Sprintf("%s covered only by wildcard SAN %s", h, w))
+			}
+		}
+	}
+	if fStrictSNI {
+		if h := t.hostname(); h != "" && cert.VerifyHostname(h) != nil {
+			out = append(out, fmt.Sprintf("cert not valid for %s, suggesting SNI is ignored and a default cert is served", h))
+		}
+	}
+	if fWeakCiphers {
+		if why, weak := weakCipher(cs.CipherSuite); weak {
+			out = append(out, fmt.Sprintf("weak cipher suite %s: %s", tls.CipherSuiteName(cs.CipherSuite), why))
+		}
+	}
+	if fChainOrder && !chainOrdered(cs.PeerCertificates) {
+		out = append(out, "misordered chain")
+	}
+	if c := nearestIntermediate(cs.PeerCertificates); c != nil && c.NotAfter.Before(cert.NotAfter) {
+		out = append(out, fmt.Sprintf("intermediate %q expires before leaf", c.Subject.CommonName))
+	}
+	return out
+}
+
+// A validity is the period during which a cert is valid.
+type validity struct {
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+func certValidity(cert *x509.Certificate) validity {
+	return validity{cert.NotBefore, cert.NotAfter}
+}
+
+// weakCipher reports whether the cipher suite id is weak, and why.
+// NULL and export suites are not listed because crypto/tls cannot offer them.
+func weakCipher(id uint16) (string, bool) {
+	name := tls.CipherSuiteName(id)
+	switch {
+	case strings.Contains(name, "_RC4_"):
+		return "RC4 is broken", true
+	case strings.Contains(name, "_3DES_"):
+		return "3DES is vulnerable to Sweet32", true
+	case strings.HasSuffix(name, "_CBC_SHA256"):
+		return "CBC mode with SHA-256 is vulnerable to Lucky13", true
+	case strings.HasPrefix(name, "TLS_RSA_"):
+		return "RSA key exchange lacks forward secrecy", true
+	}
+	return "", false
+}
+
+// weakSignature reports whether cert is signed with a broken algorithm, and
+// why.
+func weakSignature(cert *x509.Certificate) (string, bool) {
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA:
+		return "MD5 and MD2 are broken", true
+	case x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		return "SHA-1 is vulnerable to collisions", true
+	}
+	return "", false
+}
+
+// describe returns details about the connection's cert chain for -verbose.
+func describe(cs tls.ConnectionState) []string {
+	leaf := cs.PeerCertificates[0]
+	var out []string
+	out = append(out, fmt.Sprintf("valid %s to %s", formatTime(leaf.NotBefore), formatTime(leaf.NotAfter)))
+	if ahead := time.Until(leaf.NotBefore); ahead > 0 {
+		out = append(out, describeSkew(ahead))
+	}
+	if c := nearestIntermediate(cs.PeerCertificates); c != nil {
+		out = append(out, fmt.Sprintf("intermediate %q expires %s", c.Subject.CommonName, formatTime(c.NotAfter)))
+	}
+	if len(cs.OCSPResponse) > 0 {
+		if s, err := parseStaple(cs.OCSPResponse, leaf); err == nil && !s.nextUpdate.IsZero() {
+			out = append(out, fmt.Sprintf("stapled OCSP response valid %s to %s", formatTime(s.thisUpdate), formatTime(s.nextUpdate)))
+		}
+	}
+	if n := len(cs.PeerCertificates); n == 1 && !isSelfSigned(leaf) {
+		out = append(out, "chain length 1; the server may be missing intermediates")
+	} else {
+		out = append(out, fmt.Sprintf("chain length %d", n))
+	}
+	return out
+}
+
+// maxClockSkew is the largest difference between the local clock and a CA's
+// that is considered plausible.
+const maxClockSkew = 10 * time.Minute
+
+// describeSkew explains a cert whose NotBefore is ahead of the local clock by
+// ahead: a newly issued cert seen by a slightly slow clock, or a cert that is
+// not yet valid, unless the local clock is far off.
+func describeSkew(ahead time.Duration) string {
+	if ahead <= maxClockSkew {
+		return fmt.Sprintf("validity starts %s ahead of the local clock; likely a newly issued cert and a slightly slow local clock", ahead.Round(time.Second))
+	}
+	gap := ahead.Round(time.Minute).String()
+	if n := int64(ahead / (24 * time.Hour)); n > 0 {
+		gap = fmt.Sprintf("%d %s", n, pluralize(n, "day"))
+	}
+	return fmt.Sprintf("validity starts %s ahead of the local clock; the cert is not yet valid, unless the local clock is wrong", gap)
+}
+
+// isSelfSigned reports whether cert is signed by its own key. The signature
+// is checked directly, since CheckSignatureFrom rejects a parent that is not
+// a CA, as a self-signed leaf usually is not.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// nearestIntermediate returns the cert after the leaf in chain that expires
+// first, or nil if chain has only the leaf.
+func nearestIntermediate(chain []*x509.Certificate) *x509.Certificate {
+	var nearest *x509.Certificate
+	for _, c := range chain[1:] {
+		if nearest == nil || c.NotAfter.Before(nearest.NotAfter) {
+			nearest = c
+		}
+	}
+	return nearest
+}
+
+// fingerprint returns the hex-encoded SHA-256 digest of cert.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func formatTime(t time.Time) string {
+	return t.In(displayLoc).Format("2006-01-02 15:04 -0700 MST")
+}
+
+// chainOrdered reports whether chain starts with a leaf and each cert after
+// it issued the one before. Issuers are matched by name and key identifier
+// rather than signature, which does not verify for SHA-1 signatures or v1
+// CA certs in chains that are nonetheless in order.
+func chainOrdered(chain []*x509.Certificate) bool {
+	if chain[0].IsCA {
+		return false
+	}
+	for i := 1; i < len(chain); i++ {
+		child, issuer := chain[i-1], chain[i]
+		if !bytes.Equal(child.RawIssuer, issuer.RawSubject) {
+			return false
+		}
+		if len(child.AuthorityKeyId) != 0 && len(issuer.SubjectKeyId) != 0 && !bytes.Equal(child.AuthorityKeyId, issuer.SubjectKeyId) {
+			return false
+		}
+	}
+	return true
+}
+
+// wildcardSAN returns the wildcard DNS name of cert that matches name, or ""
+// if there is none.
+func wildcardSAN(cert *x509.Certificate, name string) string {
+	name = strings.TrimSuffix(name, ".")
+	_, parent, ok := strings.Cut(name, ".")
+	if !ok {
+		return ""
+	}
+	for _, n := range cert.DNSNames {
+		if strings.HasPrefix(n, "*.") && strings.EqualFold(n[2:], parent) {
+			return n
+		}
+	}
+	return ""
+}
+
+// serverAuth reports whether cert may be used by a TLS server. A cert with
+// no extended key usage is unrestricted.
+func serverAuth(cert *x509.Certificate) bool {
+	if len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 {
+		return true
+	}
+	for _, u := range cert.ExtKeyUsage {
+		if u == x509.ExtKeyUsageServerAuth || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSAN reports whether name is listed exactly, ignoring case, among the
+// DNS names of cert. Wildcards are not expanded.
+func hasSAN(cert *x509.Certificate, name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	for _, n := range cert.DNSNames {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// oidTLSFeature is the TLS Feature extension (RFC 7633), which carries the
+// OCSP Must-Staple requirement.
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// mustStaple reports whether cert requires a stapled OCSP response, that is,
+// whether its TLS Feature extension includes status_request.
+func mustStaple(cert *x509.Certificate) bool {
+	const statusRequest = 5
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidTLSFeature) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false
+		}
+		for _, f := range features {
+			if f == statusRequest {
+				return true
+			}
+		}
+	}
+	return false
+}
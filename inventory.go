@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+)
+
+// An inventoryEntry is an element of a JSON inventory, which is an array of
+// such objects:
+//
+//	[
+//		{"host": "example.org"},
+//		{"host": "10.0.0.5", "port": 8443, "servername": "internal.example.org", "warn": "60d"}
+//	]
+//
+// The fields correspond to the text format: host may be anything accepted as
+// a domain in the text format, and servername and warn are as the
+// annotations of the same names.
+type inventoryEntry struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port,omitempty"`
+	ServerName string `json:"servername,omitempty"`
+	Warn       string `json:"warn,omitempty"`
+}
+
+// looksLikeJSON reports whether b starts with a JSON array of objects, as
+// opposed to text such as "[::1]:443".
+func looksLikeJSON(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || b[0] != '[' {
+		return false
+	}
+	b = bytes.TrimSpace(b[1:])
+	return len(b) != 0 && (b[0] == '{' || b[0] == ']')
+}
+
+func inventoryDomains(b []byte) ([]target, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var entries []inventoryEntry
+	if err := dec.Decode(&entries); err != nil {
+		return nil, fmt.Errorf("inventory: %s", err)
+	}
+
+	var out []target
+	for k, e := range entries {
+		t, ok, err := e.target()
+		if err != nil {
+			return nil, fmt.Errorf("inventory entry %d: %s", k, err)
+		}
+		if !ok {
+			log.Printf("warning: inventory entry %d: skipping non-https URL", k)
+			continue
+		}
+		if ts, ok, err := cidrTargets(t); ok {
+			if err != nil {
+				return nil, fmt.Errorf("inventory entry %d: %s", k, err)
+			}
+			out = append(out, ts...)
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// target returns the target for e. It returns false if the host is a URL
+// that should be skipped, as in the text format.
+func (e inventoryEntry) target() (target, bool, error) {
+	host, err := expandEnv(e.Host)
+	if err != nil {
+		return target{}, false, err
+	}
+	serverName, err := expandEnv(e.ServerName)
+	if err != nil {
+		return target{}, false, err
+	}
+	if host == "" {
+		return target{}, false, fmt.Errorf("missing host")
+	}
+	host, ok, err := urlDomain(host)
+	if !ok || err != nil {
+		return target{}, false, err
+	}
+
+	t := target{domain: host, serverName: serverName}
+	if e.Port != 0 {
+		if _, ok := t.unixPath(); ok {
+			return target{}, false, fmt.Errorf("port given for unix socket")
+		}
+		t.domain = net.JoinHostPort(host, strconv.Itoa(e.Port))
+	}
+	if e.Warn != "" {
+		t.threshold, err = parseDays(e.Warn)
+		if err != nil {
+			return target{}, false, fmt.Errorf("warn: %s", err)
+		}
+	}
+	return t, true, nil
+}
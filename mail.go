@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+func subject() string {
+	if fTag != "" {
+		return "[" + fTag + "] " + mailSubject
+	}
+	return mailSubject
+}
+
+// A message is a mail to be sent with mail(1).
+type message struct {
+	subject     string
+	body        string
+	attachments []string // file paths; requires mail(1) to support -A
+}
+
+// sendMail mails m to recipient using mail(1). Transient failures are
+// retried, with backoff, up to -mail-retries times.
+func sendMail(recipient string, m message) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := runMail(recipient, m)
+		if err == nil || attempt >= fMailRetries || !transientMailError(err) {
+			return err
+		}
+		log.Printf("mail: %s; retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// runMail invokes -mail-bin, which is split on spaces into the program and
+// its leading arguments, to send m.
+func runMail(recipient string, m message) error {
+	bin := strings.Fields(fMailBin)
+	if len(bin) == 0 {
+		return errors.New("-mail-bin is empty")
+	}
+	subject, body := m.subject, m.body
+	var args []string
+	if fCharset.value != "none" {
+		subject, body = mimeEncode(fCharset.value, m)
+		for _, h := range mimeHeaders(fCharset.value) {
+			args = append(args, "-a", h)
+		}
+	}
+	args = append(append(bin[1:], args...), "-s", subject)
+	for _, a := range m.attachments {
+		args = append(args, "-A", a)
+	}
+	args = append(args, recipient)
+	cmd := exec.Command(bin[0], args...)
+	cmd.Stdin = strings.NewReader(body)
+	return cmd.Run()
+}
+
+// mimeHeaders returns the headers, given to mail(1) with -a, that declare
+// a -charset body encoded by mimeEncode.
+func mimeHeaders(charset string) []string {
+	return []string{
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=" + charset,
+		"Content-Transfer-Encoding: quoted-printable",
+	}
+}
+
+// mimeEncode returns the subject of m as an RFC 2047 encoded-word, if it is
+// not ASCII, and its body quoted-printable encoded, so that neither depends
+// on mail(1) or the mail path being 8-bit clean.
+func mimeEncode(charset string, m message) (subject, body string) {
+	var b strings.Builder
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(m.body)) // writes to a strings.Builder do not fail
+	w.Close()
+	return mime.QEncoding.Encode(charset, m.subject), b.String()
+}
+
+// transientMailError reports whether a failed mail(1) invocation may succeed
+// if retried. Failure to start mail(1), and exit statuses from sysexits(3)
+// that indicate a bad invocation or recipient, are permanent.
+func transientMailError(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	switch exitErr.ExitCode() {
+	case 64, 65, 67, 68: // EX_USAGE, EX_DATAERR, EX_NOUSER, EX_NOHOST
+		return false
+	}
+	return true
+}
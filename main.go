@@ -1,27 +1,55 @@
 // Command notafter sends notifications via mail(1) if TLS certs for the
 // specified domains will expire soon or have expired. The list of domains is
-// read from standard input, one per line.
+// read from standard input, one per line, as a domain, host:port, https URL,
+// or CIDR block of addresses. Blank lines and lines starting with "#" are
+// skipped.
+//
+// Environment variables in the list, written as $VAR or ${VAR}, are
+// expanded. A domain may be followed by key=value annotations, such as
+// servername=<name> to override SNI or warn=<n>d to override the
+// notification threshold, and may be given as unix:<path> to perform the
+// handshake over a unix socket.
+//
+// The list may instead be a JSON array of objects with the fields host,
+// port, servername, and warn, or, with -input-format hosts, in hosts(5)
+// format, in which case each name is checked at the address on its line.
+//
+// With -c, the recipient, flags, and domains are instead read from a single
+// configuration file: lines of flag names and values, followed by a
+// "[domains]" line and the list of domains.
+//
+// With -format short, each line of output is the domain followed by one of
+// the states ok, warning, critical, expired, or error. With -format ndjson,
+// each line is a JSON object with the fields domain, state, not_before,
+// not_after, days_remaining, fingerprint, chain_length, error, and findings.
 //
 // The program exits with a non-zero exit status upon internal errors (e.g.
 // failure to invoke mail(1)). On the other hand, any failures to reach
 // specified domains do not result in a non-zero exit status; such errors are
-// mailed instead, and the command will exit with a zero status.
+// mailed instead, and the command will exit with a zero status. The
+// exception is -max-errors: if that many domains cannot be reached, the run
+// is abandoned without mailing and exits with status 3. With
+// -fail-under-days, the report is mailed as usual, but the exit status is 4
+// if a cert has fewer than that many days remaining. With -stdin-pem, the
+// report is printed instead of mailed, and the exit status is 5 if the
+// chain needs attention. With -count-only,
+// the exit status is instead the number of domains that need attention,
+// which can coincide with the other statuses; the count printed is
+// unambiguous. The exit statuses are listed in the output of -h.
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -30,103 +58,913 @@ const (
 	mailSubject           = "notafter: domain cert expiries"
 )
 
+var (
+	fOnly           stringsFlag
+	fMaxValidity    int
+	fAllowUnset     bool
+	fDNSCacheTTL    time.Duration
+	fConfig         string
+	fFormat         = choiceFlag{"text", []string{"text", "short", "ndjson"}}
+	fWarnMissingSAN bool
+	fTag            string
+	fChainOrder     bool
+	fMailRetries    int
+	fVerbose        bool
+	fStripPort      bool
+	fAlwaysMail     bool
+	fAllIPs         bool
+	fAttachCSV      bool
+	fLocalTime      bool
+	fTZ             string
+	fJobs           jobsFlag
+	fHead           int
+	fFollow         bool
+	fBefore         dateFlag
+	fDedupCerts     bool
+	fProbeLine      string
+	fPreHook        string
+	fPostHook       string
+	fStream         bool
+	fStrictSNI      bool
+	fTest           bool
+	fMaxErrors      int
+	fWeakCiphers    bool
+	fRedact         = choiceFlag{"none", []string{"none", "mask", "hash"}}
+	fRedactMap      string
+	fDomainsCmd     string
+	fInputFormat    = choiceFlag{"auto", []string{"auto", "text", "json", "hosts"}}
+	fWarnFraction   float64
+	fSkipUnresolved bool
+	fRampDuration   time.Duration
+	fCompareTo      string
+	fCheckHSTS      bool
+	fDeadline       time.Duration
+	fCountOnly      bool
+	fResolveOnly    bool
+	fBodyPrefix     string
+	fBodySuffix     string
+	fCheckCT        bool
+	fMailBin        string
+	fHostHeader     string
+	fSummaryOnly    bool
+	fSyslog         bool
+	fRenewalHook    string
+	fFlagWildcards  bool
+	fCheckpoint     string
+	fResume         bool
+	fExpiredOnly    bool
+	fFreezeStart    dateFlag
+	fFreezeEnd      dateFlag
+	fTotalBudget    time.Duration
+	fGoodCountOnly  bool
+	fSSH            string
+	fSSHKey         string
+	fPins           string
+	fExpandSANs     bool
+	fExplain        bool
+	fStdinPEM       bool
+	fFailUnderDays  int
+	fCheckDANE      bool
+	fNormalize      = choiceFlag{"none", []string{"none", "www"}}
+	fOutputDir      string
+	fMaxSANs        int
+	fCharset        = choiceFlag{"none", []string{"none", "utf-8"}}
+	fProbeProtocols bool
+	fPortProtocols  stringsFlag
+	fCache          string
+	fCacheTTL       time.Duration
+	fDistrust       string
+)
+
+// displayLoc is the location in which times are shown in the text report.
+var displayLoc = time.UTC
+
+// hosts, if non-nil, caches host lookups made when dialing.
+var hosts *hostCache
+
+// Exit statuses. log.Fatal exits with exitInternal.
+const (
+	exitOK            = 0
+	exitInternal      = 1
+	exitUsage         = 2
+	exitTooManyErrors = 3
+	exitFailUnder     = 4
+	exitPEMAttention  = 5
+)
+
+// maxCountStatus caps the exit status with -count-only, below the statuses
+// shells reserve.
+const maxCountStatus = 125
+
+var exitStatuses = []struct {
+	code int
+	desc string
+}{
+	{exitOK, "success, including when domains need attention or could not be reached"},
+	{exitInternal, "internal error, e.g. failure to invoke mail(1)"},
+	{exitUsage, "invalid arguments"},
+	{exitTooManyErrors, "aborted by -max-errors, likely due to a local network failure; nothing is mailed"},
+	{exitFailUnder, "with -fail-under-days, a cert has fewer than that many days remaining; the report is still mailed"},
+	{exitPEMAttention, "with -stdin-pem, the cert chain needs attention; the report is printed, not mailed"},
+}
+
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: notafter [<recipient>] < domains.txt\n")
+	fmt.Fprintf(os.Stderr, "usage: notafter [flags] [<recipient>] < domains.txt\n")
+	fmt.Fprintf(os.Stderr, "       notafter [flags] -c <config> [<recipient>]\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "exit status:\n")
+	for _, e := range exitStatuses {
+		fmt.Fprintf(os.Stderr, "  %d\t%s\n", e.code, e.desc)
+	}
+	fmt.Fprintf(os.Stderr, "  0-%d\twith -count-only, the number of domains that need attention, which overlaps the statuses above (1 may also be an internal error), so read the count printed\n", maxCountStatus)
 }
 
 func main() {
 	log.SetPrefix("notafter: ")
 	log.SetFlags(0)
 
+	flag.Var(&fOnly, "only", "check only the named `domain` from the input (repeatable)")
+	flag.IntVar(&fMaxValidity, "max-validity", 0, "report certs valid for longer than `days` in total (0 disables)")
+	flag.BoolVar(&fAllowUnset, "allow-unset-env", false, "expand unset environment variables in the input to empty instead of failing")
+	flag.DurationVar(&fDNSCacheTTL, "dns-cache-ttl", 0, "cache host lookups for `duration` (0 disables)")
+	flag.StringVar(&fConfig, "c", "", "read settings, recipient, and domains from the combined config `file`")
+	flag.Var(&fFormat, "format", "output `format`: text; short for one \"<domain> <state>\" per line; or ndjson for one JSON object per line")
+	flag.BoolVar(&fWarnMissingSAN, "warn-on-missing-san", false, "report certs whose SANs do not list the domain exactly")
+	flag.StringVar(&fTag, "tag", "", "label the report and mail subject with `tag`, e.g. the environment name")
+	flag.BoolVar(&fChainOrder, "check-chain-order", false, "report servers that present the cert chain out of order")
+	flag.IntVar(&fMailRetries, "mail-retries", 0, "retry transient mail(1) failures up to `n` times")
+	flag.BoolVar(&fVerbose, "verbose", false, "include additional details about each cert")
+	flag.BoolVar(&fStripPort, "strip-port", false, "omit the port from domains given as host:port in output")
+	flag.BoolVar(&fAlwaysMail, "always-mail", false, "send the report even if no domain needs attention")
+	flag.BoolVar(&fAllIPs, "all-ips", false, "check every address each domain resolves to, reporting each separately and whether they serve different certs")
+	flag.BoolVar(&fAttachCSV, "attach-csv", false, "attach the full results as CSV to the mail; requires a mail(1) that supports -A, such as GNU Mailutils")
+	flag.BoolVar(&fLocalTime, "localtime", false, "show times in the report in the local time zone instead of UTC")
+	flag.StringVar(&fTZ, "tz", "", "show times in the report in the IANA time `zone`, e.g. America/New_York")
+	flag.Var(&fJobs, "j", "check at most `n` domains at a time, or \"auto\" to derive n from the open file limit (0 means no limit)")
+	flag.IntVar(&fHead, "head", 0, "print only the `n` most urgent domains to standard output; the mail contains all domains")
+	flag.BoolVar(&fFollow, "follow", false, "follow HTTP redirects and check the cert of the final host")
+	flag.Var(&fBefore, "before", "report certs expiring before `date` (YYYY-MM-DD, UTC) instead of within the threshold, and those already expired")
+	flag.BoolVar(&fDedupCerts, "dedup-certs", false, "list domains that are served the same cert")
+	flag.StringVar(&fProbeLine, "probe-line", "", "send `line` after the handshake and check the cert presented after any renegotiation")
+	flag.StringVar(&fPreHook, "pre-hook", "", "run shell `command` before reading the domains")
+	flag.StringVar(&fPostHook, "post-hook", "", "run shell `command` at the end of each run that makes a report, after mailing it if it is mailed, with the report on standard input; it does not run with -count-only or -resolve-only, or when -max-errors aborts the run")
+	flag.BoolVar(&fStream, "stream", false, "print each result as soon as it is available, in completion order")
+	flag.BoolVar(&fStrictSNI, "strict-sni", false, "report certs not valid for the requested name, as served when SNI is ignored")
+	flag.BoolVar(&fTest, "test", false, "send a test message to the recipient and exit without checking domains")
+	flag.IntVar(&fMaxErrors, "max-errors", 0, "abort without mailing once `n` domains fail to be checked (0 disables)")
+	flag.BoolVar(&fWeakCiphers, "weak-ciphers", false, "offer weak cipher suites and report servers that negotiate one")
+	flag.Var(&fRedact, "redact", "hide domain names in output: none, mask to show only the last two labels, or hash")
+	flag.StringVar(&fRedactMap, "redact-map", "", "write the names hidden by -redact to `file`")
+	flag.StringVar(&fDomainsCmd, "domains-cmd", "", "read the domains from the output of shell `command` instead of standard input or the -c file")
+	flag.Var(&fInputFormat, "input-format", "domains list `format`: text, json for a JSON inventory, hosts for hosts(5) lines of an address and names, or auto to detect text or json")
+	flag.Float64Var(&fWarnFraction, "warn-fraction", 0, "notify when less than `fraction` of a cert's validity period remains, instead of the fixed threshold")
+	flag.BoolVar(&fSkipUnresolved, "skip-on-resolve-failure", false, "skip domains that do not resolve instead of reporting them as errors; they are listed only with -verbose")
+	flag.DurationVar(&fRampDuration, "ramp-duration", 0, "start checks gradually over `duration`, rather than all at once, until -j are running")
+	flag.StringVar(&fCompareTo, "compare-to", "", "compare with the previous report in `file`, written with -format ndjson, noting changes in days remaining and replaced certs")
+	flag.BoolVar(&fCheckHSTS, "check-hsts", false, "make an HTTP HEAD request and report, with -verbose, the HSTS max-age advertised")
+	flag.DurationVar(&fDeadline, "deadline", 0, "stop checking after `duration` and report the domains not yet checked as timed out")
+	flag.BoolVar(&fCountOnly, "count-only", false, "print only the number of domains that need attention, exit with it as the status (at most 125), and send no mail")
+	flag.BoolVar(&fResolveOnly, "resolve-only", false, "only look up each domain, report those that do not resolve, and send no mail")
+	flag.StringVar(&fBodyPrefix, "body-prefix", "", "begin the report with `text`, or the contents of the file if given as @file")
+	flag.StringVar(&fBodySuffix, "body-suffix", "", "end the report with `text`, or the contents of the file if given as @file")
+	flag.BoolVar(&fCheckCT, "check-ct", false, "report unexpired certs in the Certificate Transparency logs, via crt.sh, other than the one served")
+	flag.StringVar(&fMailBin, "mail-bin", "mail", "send mail with `command`, which is given -s <subject> and the recipient like mail(1); it may include leading arguments")
+	flag.StringVar(&fHostHeader, "host-header", "", "send an HTTP request with the Host header `host` after the handshake, like -probe-line, for proxies that route by Host")
+	flag.BoolVar(&fSummaryOnly, "summary-only", false, "mail only a one-line count of domains by state; the full report is still printed")
+	flag.BoolVar(&fSyslog, "syslog", false, "also log each result to syslog, with a severity according to its state")
+	flag.StringVar(&fRenewalHook, "renewal-hook", "", "run `command` with sh(1) for each domain whose cert expires soon, with the domain as $1 and on standard input")
+	flag.BoolVar(&fFlagWildcards, "flag-wildcards", false, "report certs that match the domain only through a wildcard SAN")
+	flag.StringVar(&fCheckpoint, "checkpoint", "", "record each result in `file` as it completes")
+	flag.BoolVar(&fResume, "resume", false, "with -checkpoint, reuse the results already recorded and check only the remaining domains")
+	flag.BoolVar(&fExpiredOnly, "notify-threshold-expired-only", false, "notify only for expired certs and domains that could not be checked, not for certs expiring soon or other findings")
+	flag.Var(&fFreezeStart, "freeze-start", "with -freeze-end, report certs expiring from `date` (YYYY-MM-DD, UTC), such as during a change freeze")
+	flag.Var(&fFreezeEnd, "freeze-end", "with -freeze-start, report certs expiring through `date` (YYYY-MM-DD, UTC)")
+	flag.DurationVar(&fTotalBudget, "total-budget", 0, "divide `duration` among the checks, given -j, as the timeout for each, instead of 5s; at least 1s")
+	flag.BoolVar(&fGoodCountOnly, "report-good-count-only-in-summary", false, "list only the domains that need attention, and end the report with a count of those checked, good, and with problems")
+	flag.StringVar(&fSSH, "ssh", "", "connect to domains through the SSH bastion `user@host`, using ssh(1)")
+	flag.StringVar(&fSSHKey, "ssh-key", "", "with -ssh, authenticate with the private key in `file`")
+	flag.StringVar(&fPins, "pins", "", "report certs whose SHA-256 fingerprint differs from the one pinned for the domain in `file`, of \"<domain> <fingerprint>\" lines")
+	flag.BoolVar(&fExpandSANs, "expand-sans", false, "also check the names, other than wildcards, listed in the SANs of the certs checked")
+	flag.BoolVar(&fExplain, "explain", false, "explain, for each domain, why it does or does not need notification")
+	flag.BoolVar(&fStdinPEM, "stdin-pem", false, "check the PEM cert chain on standard input, leaf first, instead of connecting to domains, and print the report instead of mailing it; no recipient is needed")
+	flag.IntVar(&fFailUnderDays, "fail-under-days", 0, "exit with status 4 if a cert has fewer than `days` remaining, regardless of the notification threshold (0 disables)")
+	flag.BoolVar(&fCheckDANE, "check-dane", false, "report certs that match none of the TLSA records at _<port>._tcp.<domain>, queried from the servers in /etc/resolv.conf")
+	flag.Var(&fNormalize, "normalize", "compare domains, for duplicates, -only, and -pins, as they are (none), or without a leading \"www.\" (www), checking only the first listed of each set of duplicates")
+	flag.StringVar(&fOutputDir, "output-dir", "", "also save the full report, in the -format, to a file named for the time of the run in `dir`, e.g. notafter-20060102-150405.txt")
+	flag.IntVar(&fMaxSANs, "max-sans", 0, "report certs listing more than `n` DNS names, as shared certs often do (0 disables)")
+	flag.Var(&fCharset, "charset", "declare the mail's `charset`: none to leave it to mail(1), or utf-8 to send MIME headers with -a and encode the body; requires a mail(1) that supports -a, such as GNU Mailutils or bsd-mailx")
+	flag.BoolVar(&fProbeProtocols, "probe-all-protocols", false, "negotiate STARTTLS according to the port of each domain: SMTP on 25 and 587, IMAP on 143, and POP3 on 110; other ports speak TLS directly")
+	flag.Var(&fPortProtocols, "port-protocol", "with -probe-all-protocols, speak the protocol in `port=protocol`, one of tls, smtp, imap, or pop3, on the port (repeatable)")
+	flag.StringVar(&fCache, "cache", "", "reuse the results of earlier runs, by host and port, recorded in `file` within -cache-ttl, instead of checking again; share the file only between runs with the same checking flags")
+	flag.DurationVar(&fCacheTTL, "cache-ttl", time.Hour, "with -cache, reuse results checked within `duration`")
+	flag.StringVar(&fDistrust, "distrust", "", "report certs from CAs that are distrusted before the cert expires, per `file` of \"<YYYY-MM-DD> <CA name or fingerprint>\" lines")
 	flag.Usage = usage
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	var (
+		recipient string
+		ds        []target
+		err       error
+	)
+	// A -pre-hook given on the command line may write the -c file, so it
+	// runs before the file is read. One set in the file runs once the
+	// settings are read, and before the domains are.
+	preHookRun := false
+	if fPreHook != "" && fConfig != "" {
+		runPreHook()
+		preHookRun = true
+	}
+	if fConfig != "" {
+		recipient, err = loadConfig(fConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if flag.NArg() == 1 {
+		recipient = flag.Arg(0)
+	}
+	if flag.NArg() > 1 || (recipient == "" && !fCountOnly && !fResolveOnly && !fStdinPEM) {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if fResume && fCheckpoint == "" {
+		log.Print("-resume requires -checkpoint")
 		usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 
-	recipient := flag.Arg(0)
-	ctx := context.Background()
-	now := time.Now()
+	if fCharset.value != "none" && fAttachCSV {
+		log.Print("-charset and -attach-csv are mutually exclusive")
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if fProbeLine != "" && fHostHeader != "" {
+		log.Print("-probe-line and -host-header are mutually exclusive")
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if fFreezeStart.t.IsZero() != fFreezeEnd.t.IsZero() || fFreezeEnd.t.Before(fFreezeStart.t) {
+		log.Print("-freeze-start and -freeze-end must be given together, in order")
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if fFailUnderDays < 0 {
+		log.Print("-fail-under-days must not be negative")
+		usage()
+		os.Exit(exitUsage)
+	}
 
-	// parse domains.
-	ds, err := domains(os.Stdin)
+	if fSyslog && !syslogSupported {
+		log.Print("-syslog is not supported on this platform")
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if fWarnFraction < 0 || fWarnFraction > 1 {
+		log.Print("-warn-fraction must be between 0 and 1")
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	prefix, err := bodyText(fBodyPrefix)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if len(ds) == 0 {
-		log.Fatal("no domains") // prevent common misconfiguration
+	suffix, err := bodyText(fBodySuffix)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	items := make([]Item, len(ds))
+	if fTest {
+		m := message{subject: subject(), body: "notafter test message\n"}
+		if err := sendMail(recipient, m); err != nil {
+			log.Fatalf("test message to %s failed: %s (is mail(1) installed and able to deliver mail?)", recipient, err)
+		}
+		log.Printf("test message sent to %s", recipient)
+		os.Exit(exitOK)
+	}
+
+	switch {
+	case fLocalTime && fTZ != "":
+		log.Print("-localtime and -tz are mutually exclusive")
+		usage()
+		os.Exit(exitUsage)
+	case fLocalTime:
+		displayLoc = time.Local
+	case fTZ != "":
+		displayLoc, err = time.LoadLocation(fTZ)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if fDNSCacheTTL > 0 {
+		hosts = newHostCache(fDNSCacheTTL)
+	}
+	if fPins != "" {
+		pins, err = loadPins(fPins)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if fProbeProtocols {
+		portProtocols, err = loadPortProtocols(fPortProtocols)
+		if err != nil {
+			log.Print(err)
+			usage()
+			os.Exit(exitUsage)
+		}
+	}
+	if fDistrust != "" {
+		distrusts, err = loadDistrust(fDistrust)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if fCompareTo != "" {
+		previous, err = loadPrevious(fCompareTo)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	now := time.Now()
 
-	var wg sync.WaitGroup
-	for i := range ds {
-		wg.Add(1)
-		go func(idx int) {
-			defer wg.Done()
-			end, err := getCertEnd(ctx, ds[idx])
-			items[idx] = Item{ds[idx], end, err}
-		}(i)
+	if fPreHook != "" && !preHookRun {
+		runPreHook()
+	}
+	if fConfig != "" {
+		ds, err = configDomains(fConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	wg.Wait()
 
-	noNotify := func(i Item) bool { return !i.needsNotify(now) }
-	if all(items, noNotify) {
-		os.Exit(0)
+	stream := fStream && !fCountOnly
+	var items []Item
+	if fStdinPEM {
+		ds, items, err = pemItems(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if stream {
+			fmt.Print(prefix + reportHeader(headerLines()))
+			for _, i := range items {
+				if line, ok := i.reportLine(now); ok {
+					fmt.Println(line)
+				}
+			}
+		}
+	} else {
+		ds = inputTargets(ctx, ds)
+		if stream {
+			fmt.Print(prefix + reportHeader(headerLines()))
+		}
+		ds, items = checkTargets(ctx, ds, stream, now)
+	}
+
+	if fAllIPs {
+		markInconsistent(ds, items, now)
+	}
+
+	// finish the streamed report with the sections that depend on all the
+	// results.
+	if stream {
+		if clockSuspect(items, now) && fFormat.value == "text" {
+			fmt.Print("\n" + clockWarning + "\n")
+		}
+		fmt.Print(reportTrailer(items, now) + suffix)
+	}
+
+	if fRenewalHook != "" {
+		runRenewalHook(ds, items, now)
+	}
+
+	if fSyslog {
+		if err := writeSyslog(items, now); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if fRedactMap != "" {
+		if err := writeRedactMap(fRedactMap); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if fOutputDir != "" {
+		if err := writeReport(fOutputDir, prefix+resultsBody(items, now)+suffix, now); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	body := resultsBody(items, now)
+	if fCountOnly {
+		var n int
+		for _, i := range items {
+			if i.needsNotify(now) {
+				n++
+			}
+		}
+		fmt.Println(n)
+		if n > maxCountStatus {
+			n = maxCountStatus
+		}
+		os.Exit(n)
+	}
+
+	status := exitOK
+	if fFailUnderDays > 0 && !all(items, func(i Item) bool { return !i.failsUnder(now) }) {
+		status = exitFailUnder
+	}
+
+	body := prefix + resultsBody(items, now) + suffix
+
+	noNotify := func(i Item) bool { return !i.needsNotify(now) }
+	if all(items, noNotify) && !fAlwaysMail && !fStdinPEM {
+		runPostHook(body)
+		os.Exit(status)
+	}
 
 	// print results to stdout.
-	fmt.Print(body)
+	switch {
+	case fStream:
+		// the report is already printed.
+	case fHead > 0 && fHead < len(items):
+		// the header and trailer are for all the items, not just the head.
+		fmt.Print(prefix + resultsHeader(items, now) + reportLines(mostUrgent(items, fHead), now))
+		if fFormat.value == "text" {
+			fmt.Printf("... and %d more\n", len(items)-fHead)
+		}
+		fmt.Print(reportTrailer(items, now) + suffix)
+	default:
+		fmt.Print(body)
+	}
+
+	// a -stdin-pem report is for the caller, not the recipient.
+	if fStdinPEM {
+		runPostHook(body)
+		if status == exitOK && !all(items, noNotify) {
+			status = exitPEMAttention
+		}
+		os.Exit(status)
+	}
 
 	// mail the results.
-	err = sendMail(recipient, body)
+	mailBody := body
+	if fSummaryOnly {
+		mailBody = prefix + summaryLine(items, now) + "\n" + suffix
+	}
+	err = mailResults(recipient, mailBody, items, now)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	runPostHook(body)
+	os.Exit(status)
 }
 
-func resultsBody(items []Item, now time.Time) string {
-	var buf bytes.Buffer
-	for _, i := range items {
-		buf.WriteString(i.format(now))
-		buf.WriteByte('\n')
+// runPreHook runs -pre-hook.
+func runPreHook() {
+	if err := runHook("-pre-hook", fPreHook, ""); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runPostHook runs -post-hook, if set, with the report body.
+func runPostHook(body string) {
+	if fPostHook == "" {
+		return
+	}
+	if err := runHook("-post-hook", fPostHook, body); err != nil {
+		log.Fatal(err)
 	}
-	return buf.String()
 }
 
-func sendMail(recipient string, body string) error {
-	cmd := exec.Command("mail", "-s", mailSubject, recipient)
-	cmd.Stdin = strings.NewReader(body)
-	return cmd.Run()
+// inputTargets returns the targets to check: ds, from the -c config, or else
+// those read from -domains-cmd or standard input, without the duplicates
+// found with -normalize, limited by -only and expanded by -all-ips. With
+// -resolve-only, it reports the resolution of the targets and exits
+// instead.
+func inputTargets(ctx context.Context, ds []target) []target {
+	var err error
+	switch {
+	case fDomainsCmd != "":
+		ds, err = commandDomains(fDomainsCmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case fConfig == "":
+		ds, err = domains(os.Stdin, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(ds) == 0 {
+		log.Fatal("no domains") // prevent common misconfiguration
+	}
+	if fNormalize.value != "none" {
+		ds = dedupDomains(ds)
+	}
+	if len(fOnly) != 0 {
+		ds, err = onlyDomains(ds, fOnly)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if fResolveOnly {
+		reportResolution(ds, resolveAll(ctx, ds))
+		os.Exit(exitOK)
+	}
+	if fAllIPs {
+		ds = expandIPs(ctx, ds)
+	}
+	return ds
+}
+
+// checkTargets checks ds, reusing the results in the -checkpoint file with
+// -resume and those fresh in the -cache file, and returns the targets
+// checked, which include those found with -expand-sans, and their results.
+// With stream set, each result is printed as it becomes available.
+func checkTargets(ctx context.Context, ds []target, stream bool, now time.Time) ([]target, []Item) {
+	var err error
+	var cp *checkpoint
+	var resumed map[string]checkpointEntry
+	if fCheckpoint != "" {
+		cp, resumed, err = openCheckpoint(fCheckpoint, fResume)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer cp.Close()
+	}
+	var cache *resultCache
+	if fCache != "" {
+		cache, err = loadCache(fCache, fCacheTTL, now)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	items := make([]Item, len(ds))
+	var todo []target
+	var todoIndex []int // index in ds of each of todo
+	var reused []int    // index in ds of the results resumed or cached
+	nResumed := 0
+	for k, t := range ds {
+		if e, ok := resumed[cacheKey(t)]; ok {
+			items[k] = e.item(t, "the checkpoint")
+			nResumed++
+		} else if e, ok := cache.lookup(t); ok {
+			items[k] = cache.item(e, t)
+		} else {
+			todo = append(todo, t)
+			todoIndex = append(todoIndex, k)
+			continue
+		}
+		reused = append(reused, k)
+	}
+	if nResumed != 0 {
+		log.Printf("resuming: %d of %d domains already checked", nResumed, len(ds))
+	}
+	if stream {
+		for _, k := range reused {
+			if line, ok := items[k].reportLine(now); ok {
+				fmt.Println(line)
+			}
+		}
+	}
+	if fTotalBudget > 0 {
+		checkTimeout = budgetTimeout(fTotalBudget, len(todo), fJobs.limit())
+		if fVerbose {
+			log.Printf("timeout for each check: %s", checkTimeout)
+		}
+	}
+
+	// -deadline is for the whole run, including the -expand-sans checks.
+	var deadline time.Time
+	if fDeadline > 0 {
+		deadline = time.Now().Add(fDeadline)
+	}
+	progress := func(ts []target) func(int, Item) {
+		return func(k int, i Item) {
+			if line, ok := i.reportLine(now); ok && stream {
+				fmt.Println(line)
+			}
+			if cp != nil {
+				if err := cp.record(ts[k], i, now); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if cache != nil {
+				cache.add(ts[k], i, now)
+			}
+		}
+	}
+	checked, err := checkAll(ctx, todo, deadline, progress(todo))
+	exitIfTooManyErrors(err)
+	for k, i := range checked {
+		items[todoIndex[k]] = i
+	}
+	if fExpandSANs {
+		if extra := sanTargets(ds, items); len(extra) != 0 {
+			if fVerbose {
+				log.Printf("checking %d more %s from cert SANs", len(extra), pluralize(int64(len(extra)), "name"))
+			}
+			more, err := checkAll(ctx, extra, deadline, progress(extra))
+			exitIfTooManyErrors(err)
+			ds = append(ds, extra...)
+			items = append(items, more...)
+		}
+	}
+	if cache != nil {
+		if err := cache.write(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return ds, items
+}
+
+func exitIfTooManyErrors(err error) {
+	if err == errTooManyErrors {
+		log.Printf("aborted after %d %s; the network may be unavailable", fMaxErrors, pluralize(int64(fMaxErrors), "error"))
+		os.Exit(exitTooManyErrors)
+	}
+}
+
+// reportResolution prints the targets in ts that did not resolve and a
+// count of those that did. With -verbose, the addresses of the others are
+// printed too.
+func reportResolution(ts []target, rs []resolution) {
+	var bad int
+	for k, r := range rs {
+		switch {
+		case r.err != nil:
+			bad++
+			fmt.Printf("%s: %v\n", ts[k].displayName(), r.err)
+		case fVerbose && len(r.addrs) != 0:
+			fmt.Printf("%s: resolves to %s\n", ts[k].displayName(), strings.Join(r.addrs, ", "))
+		}
+	}
+	fmt.Printf("%d of %d %s resolve\n", len(ts)-bad, len(ts), pluralize(int64(len(ts)), "domain"))
+}
+
+// bodyText returns the text given to -body-prefix or -body-suffix, which is
+// read from a file if v is of the form @file. Non-empty text is terminated
+// with a newline.
+func bodyText(v string) (string, error) {
+	if strings.HasPrefix(v, "@") {
+		b, err := os.ReadFile(v[1:])
+		if err != nil {
+			return "", err
+		}
+		v = string(b)
+	}
+	if v != "" && !strings.HasSuffix(v, "\n") {
+		v += "\n"
+	}
+	return v, nil
+}
+
+func mailResults(recipient, body string, items []Item, now time.Time) error {
+	m := message{subject: subject(), body: body}
+	if fAttachCSV {
+		dir, err := os.MkdirTemp("", "notafter")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "notafter.csv")
+		if err := os.WriteFile(path, resultsCSV(items, now), 0o600); err != nil {
+			return err
+		}
+		m.attachments = append(m.attachments, path)
+	}
+	return sendMail(recipient, m)
 }
 
 type Item struct {
-	domain string
-	end    time.Time
-	err    error // generic error
+	domain   string
+	validity               // of the leaf cert; zero if err is set
+	err      error         // generic error
+	findings []string      // problems other than expiry
+	details  []string      // additional information for -verbose
+	elapsed  time.Duration // time taken to connect and complete the handshake
+
+	redirects   []string // hosts redirected to, with -follow
+	fingerprint string   // SHA-256 of the leaf cert, hex-encoded
+	chainLength int      // number of certs presented by the server
+
+	threshold time.Duration // overrides notifyExpiryThreshold if non-zero
+
+	skipped     bool // err is a name that does not resolve, with -skip-on-resolve-failure
+	pinMismatch bool // the cert differs from the one pinned with -pins
+
+	sans []string // DNS names in the cert, for -expand-sans
+}
+
+func newItem(t target, r connResult, err error) Item {
+	if err != nil {
+		return Item{domain: t.displayName(), err: err, redirects: r.redirects}
+	}
+	cs := r.state
+	ft := finalTarget(t, r)
+	i := Item{
+		domain:      t.displayName(),
+		threshold:   t.threshold,
+		validity:    certValidity(cs.PeerCertificates[0]),
+		findings:    inspect(ft, cs),
+		details:     describe(cs),
+		redirects:   r.redirects,
+		fingerprint: fingerprint(cs.PeerCertificates[0]),
+		chainLength: len(cs.PeerCertificates),
+		sans:        cs.PeerCertificates[0].DNSNames,
+	}
+	if r.hsts != "" {
+		i.details = append(i.details, r.hsts)
+	}
+	if want, ok := pins[normalizeDomain(ft.domain)]; ok && i.fingerprint != want {
+		i.pinMismatch = true
+		i.findings = append(i.findings, fmt.Sprintf("cert %s does not match the pinned %s, suggesting interception or an unplanned rotation", i.fingerprint[:16], want[:16]))
+	}
+	if r.probeCert != nil {
+		i.findings = append(i.findings, fmt.Sprintf("cert changed after probe, from one expiring %s", formatTime(r.probeCert.NotAfter)))
+	}
+	return i
 }
 
 func (i Item) needsNotify(now time.Time) bool {
+	notify, _ := i.notifyDecision(now)
+	return notify
+}
+
+// notifyDecision reports whether i needs notification, and why, for
+// -explain.
+func (i Item) notifyDecision(now time.Time) (bool, string) {
+	if i.skipped {
+		return false, "not notified: does not resolve, with -skip-on-resolve-failure"
+	}
 	if i.err != nil {
-		return true
+		return true, "notified: could not be checked"
+	}
+	days := daysRemaining(i.notAfter, now)
+	if fExpiredOnly {
+		if !now.Before(i.notAfter) {
+			return true, "notified: expired"
+		}
+		return false, fmt.Sprintf("not notified: %d days remaining, and only expired certs are notified", days)
+	}
+	if n := len(i.findings); n != 0 {
+		return true, fmt.Sprintf("notified: %d %s", n, pluralize(int64(n), "finding"))
+	}
+	if !fBefore.t.IsZero() {
+		if !now.Before(i.notAfter) {
+			return true, "notified: expired"
+		}
+		if i.expiresSoon(now) {
+			return true, "notified: expires before -before " + fBefore.String()
+		}
+		return false, "not notified: expires after -before " + fBefore.String()
+	}
+	threshold, source := i.expiryThreshold()
+	limit := fmt.Sprintf("the %s threshold (%s)", formatDays(threshold), source)
+	if i.expiresSoon(now) {
+		return true, fmt.Sprintf("notified: %d days remaining, within %s", days, limit)
+	}
+	return false, fmt.Sprintf("not notified: %d days remaining, beyond %s", days, limit)
+}
+
+// expiresSoon reports whether the cert expires within the notification
+// window: before the -before date if set, or else within the threshold
+// given by expiryThreshold. A cert that has expired always does, even if
+// the -before date is past.
+func (i Item) expiresSoon(now time.Time) bool {
+	if !fBefore.t.IsZero() {
+		return i.notAfter.Before(fBefore.t) || !now.Before(i.notAfter)
 	}
-	if i.end.Sub(now) > notifyExpiryThreshold {
+	threshold, _ := i.expiryThreshold()
+	return i.notAfter.Sub(now) <= threshold
+}
+
+// failsUnder reports whether the cert has fewer than -fail-under-days
+// remaining. Domains that could not be checked do not count.
+func (i Item) failsUnder(now time.Time) bool {
+	if i.err != nil || i.skipped {
 		return false
 	}
-	return true
+	return i.notAfter.Sub(now) < time.Duration(fFailUnderDays)*24*time.Hour
+}
+
+// expiryThreshold returns the notification threshold for i and where it
+// comes from: the domain's warn annotation, or else the -warn-fraction of
+// the cert's validity period if set, or else the default.
+func (i Item) expiryThreshold() (time.Duration, string) {
+	if i.threshold != 0 {
+		return i.threshold, "warn annotation"
+	}
+	if fWarnFraction > 0 {
+		if t := time.Duration(fWarnFraction * float64(i.notAfter.Sub(i.notBefore))); t != 0 {
+			return t, "-warn-fraction"
+		}
+	}
+	return notifyExpiryThreshold, "default"
+}
+
+// formatDays formats d in whole days, e.g. "28-day".
+func formatDays(d time.Duration) string {
+	return fmt.Sprintf("%d-day", int64(d/(24*time.Hour)))
+}
+
+// mostUrgent returns the n most urgent items: those that could not be
+// checked, followed by the rest in order of expiry, followed by those
+// skipped.
+func mostUrgent(items []Item, n int) []Item {
+	sorted := make([]Item, len(items))
+	copy(sorted, items)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		ia, ib := sorted[a], sorted[b]
+		if ia.skipped != ib.skipped {
+			return ib.skipped
+		}
+		if (ia.err != nil) != (ib.err != nil) {
+			return ia.err != nil
+		}
+		return ia.notAfter.Before(ib.notAfter)
+	})
+	return sorted[:n]
+}
+
+// A state is a one-word summary of an Item. The set of states is part of the
+// -format short output and should not change.
+type state string
+
+const (
+	stateOK       state = "ok"       // not expiring soon and no findings
+	stateWarning  state = "warning"  // expiring within the threshold, or has findings
+	stateCritical state = "critical" // expiring within 24h, or not matching its -pins entry
+	stateExpired  state = "expired"
+	stateError    state = "error" // cert could not be fetched
+)
+
+func (i Item) state(now time.Time) state {
+	if i.err != nil {
+		return stateError
+	}
+	gap := i.notAfter.Sub(now)
+	switch {
+	case gap < 0:
+		return stateExpired
+	case gap < 24*time.Hour || i.pinMismatch:
+		return stateCritical
+	case i.expiresSoon(now) || len(i.findings) != 0:
+		return stateWarning
+	default:
+		return stateOK
+	}
+}
+
+// line returns i formatted for the report according to -format.
+func (i Item) line(now time.Time) string {
+	switch fFormat.value {
+	case "short":
+		return i.domain + " " + string(i.state(now))
+	case "ndjson":
+		return i.json(now)
+	default:
+		return i.format(now)
+	}
 }
 
 func (i Item) format(now time.Time) string {
 	var w strings.Builder
-	w.WriteString(i.domain + ": ")
+	w.WriteString(i.domain)
+	for _, r := range i.redirects {
+		w.WriteString(" -> " + r)
+	}
+	w.WriteString(": ")
 	if i.err != nil {
 		w.WriteString(i.err.Error())
 	} else {
-		w.WriteString(expiryInfo(i.end, now))
+		if i.expiresSoon(now) {
+			w.WriteString(expiryInfo(i.notAfter, now))
+		} else {
+			w.WriteString("good")
+		}
+		for _, f := range i.findings {
+			w.WriteString("; " + f)
+		}
+	}
+	if fVerbose {
+		if i.elapsed > 0 {
+			fmt.Fprintf(&w, " (handshake %s)", i.elapsed.Round(time.Millisecond))
+		}
+		for _, d := range i.details {
+			w.WriteString("\n\t" + d)
+		}
+	}
+	if fExplain {
+		_, why := i.notifyDecision(now)
+		w.WriteString("\n\t" + why)
 	}
 	return w.String()
 }
@@ -134,8 +972,6 @@ func (i Item) format(now time.Time) string {
 func expiryInfo(end, now time.Time) string {
 	gap := end.Sub(now)
 	switch {
-	case gap > notifyExpiryThreshold:
-		return "good"
 	case gap < 0:
 		return "expired"
 	case gap < 24*time.Hour:
@@ -146,52 +982,116 @@ func expiryInfo(end, now time.Time) string {
 	}
 }
 
-func getCertEnd(ctx context.Context, domain string) (time.Time, error) {
-	dialer := &tls.Dialer{
-		Config: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+func pluralize(n int64, noun string) string {
+	if n == 1 {
+		return noun
 	}
+	return noun + "s"
+}
 
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
+func all[E any](s []E, f func(E) bool) bool {
+	for _, v := range s {
+		if !f(v) {
+			return false
+		}
+	}
+	return true
+}
 
-	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:443", domain))
-	if err != nil {
-		return time.Time{}, err
+// stringsFlag is a flag.Value for a flag that may be repeated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// choiceFlag is a flag.Value that accepts one of a fixed set of values.
+type choiceFlag struct {
+	value   string
+	choices []string
+}
+
+func (c *choiceFlag) String() string { return c.value }
+
+func (c *choiceFlag) Set(v string) error {
+	for _, ch := range c.choices {
+		if v == ch {
+			c.value = v
+			return nil
+		}
 	}
-	defer conn.Close()
-	tlsConn := conn.(*tls.Conn) // guaranteed in package documentation
+	return fmt.Errorf("must be one of %s", strings.Join(c.choices, ", "))
+}
+
+// jobsFlag is the value of the -j flag: a number, or "auto".
+type jobsFlag struct {
+	n    int
+	auto bool
+}
 
-	cs := tlsConn.ConnectionState().PeerCertificates
-	if len(cs) == 0 {
-		return time.Time{}, errors.New("no peer certificates")
+func (j *jobsFlag) String() string {
+	if j.auto {
+		return "auto"
 	}
-	leaf := cs[0]
-	return leaf.NotAfter, nil
+	return strconv.Itoa(j.n)
 }
 
-func domains(r io.Reader) ([]string, error) {
-	scanner := bufio.NewScanner(r)
-	var out []string
-	for scanner.Scan() {
-		out = append(out, strings.TrimSpace(scanner.Text()))
+func (j *jobsFlag) Set(v string) error {
+	if v == "auto" {
+		*j = jobsFlag{auto: true}
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return errors.New("must be a non-negative integer or \"auto\"")
 	}
-	return out, scanner.Err()
+	*j = jobsFlag{n: n}
+	return nil
 }
 
-func pluralize(n int64, noun string) string {
-	if n == 1 {
-		return noun
+// defaultAutoJobs is the concurrency used by -j auto when the open file
+// limit cannot be determined.
+const defaultAutoJobs = 64
+
+// limit returns the maximum number of concurrent checks, or 0 for no limit.
+// With "auto", it is half the open file limit, leaving room for the files
+// the process otherwise needs.
+func (j *jobsFlag) limit() int {
+	if !j.auto {
+		return j.n
 	}
-	return noun + "s"
+	nofile, err := maxOpenFiles()
+	if err != nil || nofile < 2 {
+		return defaultAutoJobs
+	}
+	if nofile/2 > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(nofile / 2)
 }
 
-func all[E any](s []E, f func(E) bool) bool {
-	for _, v := range s {
-		if !f(v) {
-			return false
-		}
+// dateFlag is a flag.Value for a date in YYYY-MM-DD form.
+type dateFlag struct {
+	t time.Time // zero if unset
+}
+
+const dateLayout = "2006-01-02"
+
+func (d *dateFlag) String() string {
+	if d.t.IsZero() {
+		return ""
 	}
-	return true
+	return d.t.Format(dateLayout)
+}
+
+func (d *dateFlag) Set(v string) error {
+	t, err := time.Parse(dateLayout, v)
+	if err != nil {
+		return errors.New("must be a date in YYYY-MM-DD form")
+	}
+	d.t = t
+	return nil
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// ocspStaleThreshold is how close to its NextUpdate a stapled OCSP response
+// may get before it is reported. Servers are expected to refresh staples
+// well before then.
+const ocspStaleThreshold = 24 * time.Hour
+
+// oidOCSPBasic identifies a basic OCSP response (RFC 6960, section 4.2.1).
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// The types below are the parts of the OCSP response ASN.1 structure
+// (RFC 6960, section 4.2.1) needed to find a response's validity window.
+// The signature is not verified.
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	CertStatus asn1.RawValue
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+// A staple is the part of a stapled OCSP response that concerns one cert.
+type staple struct {
+	revoked    bool
+	thisUpdate time.Time
+	nextUpdate time.Time // zero if newer information is always available
+}
+
+// parseStaple parses the stapled OCSP response der and returns its entry for
+// cert.
+func parseStaple(der []byte, cert *x509.Certificate) (staple, error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return staple{}, err
+	}
+	if resp.Status != 0 {
+		return staple{}, fmt.Errorf("response status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return staple{}, fmt.Errorf("unsupported response type %s", resp.Response.ResponseType)
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return staple{}, err
+	}
+	for _, r := range basic.TBSResponseData.Responses {
+		if r.CertID.SerialNumber == nil || r.CertID.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			continue
+		}
+		return staple{
+			revoked:    r.CertStatus.Class == asn1.ClassContextSpecific && r.CertStatus.Tag == 1,
+			thisUpdate: r.ThisUpdate,
+			nextUpdate: r.NextUpdate,
+		}, nil
+	}
+	return staple{}, errors.New("no entry for the leaf cert")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// pemItems reads a PEM bundle, a leaf cert followed by its chain, from r for
+// -stdin-pem and returns an Item for each cert, reporting the checks that
+// need no connection. The targets returned, one per Item, are empty.
+func pemItems(r io.Reader) ([]target, []Item, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cert %d: %v", len(chain)+1, err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, nil, errors.New("no PEM certs on standard input")
+	}
+
+	ts := make([]target, len(chain))
+	items := make([]Item, len(chain))
+	for k, cert := range chain {
+		cs := tls.ConnectionState{PeerCertificates: chain[k:]}
+		i := newItem(ts[k], connResult{state: cs}, nil)
+		i.domain = fmt.Sprintf("cert %d (%s)", k+1, cert.Subject.CommonName)
+		if k != 0 {
+			// the leaf checks do not apply to the rest of the chain.
+			i.findings = nil
+			i.details = i.details[:1]
+		}
+		// the signature on a root is not relied on, and crypto/x509 cannot
+		// verify weak ones anyway, so roots are recognized by name alone.
+		root := bytes.Equal(cert.RawIssuer, cert.RawSubject)
+		if why, weak := weakSignature(cert); weak && !root {
+			i.findings = append(i.findings, fmt.Sprintf("weak signature algorithm %s: %s", cert.SignatureAlgorithm, why))
+		}
+		items[k] = i
+	}
+	return ts, items, nil
+}
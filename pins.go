@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// pins, if non-nil, maps domains, as normalized by normalizeDomain, to the
+// expected SHA-256 fingerprint of their leaf cert, from -pins.
+var pins map[string]string
+
+// loadPins reads a -pins file: lines of a domain and the hex-encoded
+// SHA-256 fingerprint of its cert, optionally with colons between bytes.
+// Blank lines and lines starting with "#" are ignored.
+func loadPins(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a domain and a fingerprint", path, n)
+		}
+		fp := strings.ToLower(strings.ReplaceAll(fields[1], ":", ""))
+		if b, err := hex.DecodeString(fp); err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-256 fingerprint %q", path, n, fields[1])
+		}
+		out[normalizeDomain(fields[0])] = fp
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
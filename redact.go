@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redactions records the names replaced by -redact, for -redact-map.
+var redactions = struct {
+	sync.Mutex
+	m map[string]string // original -> redacted
+}{m: make(map[string]string)}
+
+// redactName returns the replacement for host under -redact. With "mask",
+// all but the last two labels of a DNS name are masked; with "hash", and for
+// IP addresses in either mode, the name is replaced with a stable hash.
+func redactName(host string) string {
+	var r string
+	labels := strings.Split(host, ".")
+	switch {
+	case fRedact.value == "mask" && net.ParseIP(host) == nil:
+		if len(labels) <= 2 {
+			return host
+		}
+		r = "***." + strings.Join(labels[len(labels)-2:], ".")
+	default:
+		sum := sha256.Sum256([]byte(host))
+		r = "host-" + hex.EncodeToString(sum[:4])
+	}
+	redactions.Lock()
+	redactions.m[host] = r
+	redactions.Unlock()
+	return r
+}
+
+// redact returns i with the host names for t, the address dialed for it, if
+// any, and any hosts redirected to, replaced throughout.
+func redact(i Item, t target) Item {
+	var names []string
+	if _, ok := t.unixPath(); ok {
+		names = append(names, t.domain)
+	} else {
+		host, _ := t.hostPort()
+		names = append(names, host)
+		if t.serverName != "" {
+			names = append(names, t.serverName)
+		}
+	}
+	if t.ip != "" {
+		names = append(names, t.ip)
+	}
+	for _, r := range i.redirects {
+		host, _, err := net.SplitHostPort(r)
+		if err != nil {
+			host = r
+		}
+		names = append(names, host)
+	}
+	// replace longer names first, in case one contains another.
+	sort.Slice(names, func(a, b int) bool { return len(names[a]) > len(names[b]) })
+	var pairs []string
+	for _, n := range names {
+		pairs = append(pairs, n, redactName(n))
+	}
+	rep := strings.NewReplacer(pairs...)
+
+	i.domain = rep.Replace(i.domain)
+	i.redirects = replaceAll(rep, i.redirects)
+	i.findings = replaceAll(rep, i.findings)
+	i.details = replaceAll(rep, i.details)
+	if i.err != nil {
+		i.err = errors.New(rep.Replace(i.err.Error()))
+	}
+	return i
+}
+
+func replaceAll(rep *strings.Replacer, s []string) []string {
+	if s == nil {
+		return nil
+	}
+	out := make([]string, len(s))
+	for k, v := range s {
+		out[k] = rep.Replace(v)
+	}
+	return out
+}
+
+// writeRedactMap writes the names replaced by -redact to path, one
+// "<redacted> <original>" pair per line.
+func writeRedactMap(path string) error {
+	redactions.Lock()
+	defer redactions.Unlock()
+	var lines []string
+	for orig, r := range redactions.m {
+		if orig != r {
+			lines = append(lines, fmt.Sprintf("%s %s\n", r, orig))
+		}
+	}
+	sort.Strings(lines)
+	return os.WriteFile(path, []byte(strings.Join(lines, "")), 0o600)
+}
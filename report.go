@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func resultsBody(items []Item, now time.Time) string {
+	return resultsHeader(items, now) + reportLines(items, now) + reportTrailer(items, now)
+}
+
+// resultsHeader returns the header of the report on items.
+func resultsHeader(items []Item, now time.Time) string {
+	header := headerLines()
+	if clockSuspect(items, now) {
+		header = append(header, clockWarning)
+	}
+	return reportHeader(header)
+}
+
+// reportLines returns the lines of the report for items.
+func reportLines(items []Item, now time.Time) string {
+	var buf bytes.Buffer
+	for _, i := range items {
+		if line, ok := i.reportLine(now); ok {
+			buf.WriteString(line + "\n")
+		}
+	}
+	return buf.String()
+}
+
+const clockWarning = "warning: most certs appear expired; check that the local clock is correct"
+
+// headerLines returns the lines of the report header that do not depend on
+// the results.
+func headerLines() []string {
+	var header []string
+	if fTag != "" {
+		header = append(header, "tag: "+fTag)
+	}
+	if !fBefore.t.IsZero() {
+		header = append(header, "reporting certs expiring before "+fBefore.String())
+	}
+	return header
+}
+
+// reportHeader formats the header lines, followed by a blank line, for the
+// text format; the other formats have no header.
+func reportHeader(header []string) string {
+	if fFormat.value != "text" || len(header) == 0 {
+		return ""
+	}
+	return strings.Join(header, "\n") + "\n\n"
+}
+
+// reportLine returns the line for i in the report, or false if it is left
+// out: skipped, or good with -report-good-count-only-in-summary.
+func (i Item) reportLine(now time.Time) (string, bool) {
+	if i.skipped || (fGoodCountOnly && !i.needsNotify(now)) {
+		return "", false
+	}
+	return i.line(now), true
+}
+
+// reportTrailer returns the sections that follow the lines of the report in
+// the text format.
+func reportTrailer(items []Item, now time.Time) string {
+	if fFormat.value != "text" {
+		return ""
+	}
+	var buf bytes.Buffer
+	var skipped []string
+	for _, i := range items {
+		if i.skipped {
+			skipped = append(skipped, i.domain)
+		}
+	}
+	if len(skipped) != 0 && fVerbose {
+		fmt.Fprintf(&buf, "\nskipped %d %s that did not resolve: %s\n",
+			len(skipped), pluralize(int64(len(skipped)), "domain"), strings.Join(skipped, ", "))
+	}
+	if fGoodCountOnly {
+		buf.WriteString("\n" + totalsLine(items, now) + "\n")
+	}
+	if fDedupCerts {
+		buf.WriteString(sharedCerts(items, now))
+	}
+	if fVerbose {
+		buf.WriteString(expiryStats(items, now))
+	}
+	return buf.String()
+}
+
+// summaryStates is the order of states in summaryLine, most urgent first.
+var summaryStates = []state{stateExpired, stateCritical, stateWarning, stateError, stateOK}
+
+// summaryLine counts items by state, e.g. "5 domains: 1 expired, 3 warning,
+// 1 ok". Skipped items are counted separately.
+func summaryLine(items []Item, now time.Time) string {
+	counts := make(map[state]int)
+	var checked, skipped int
+	for _, i := range items {
+		if i.skipped {
+			skipped++
+			continue
+		}
+		checked++
+		counts[i.state(now)]++
+	}
+	var parts []string
+	for _, s := range summaryStates {
+		if counts[s] != 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[s], s))
+		}
+	}
+	if skipped != 0 {
+		parts = append(parts, fmt.Sprintf("%d skipped", skipped))
+	}
+	return fmt.Sprintf("%d %s: %s", checked, pluralize(int64(checked), "domain"), strings.Join(parts, ", "))
+}
+
+// totalsLine counts the items checked, those that are good, and those that
+// need attention, e.g. "247 checked, 244 good, 3 problems".
+func totalsLine(items []Item, now time.Time) string {
+	var checked, good, skipped int
+	for _, i := range items {
+		switch {
+		case i.skipped:
+			skipped++
+			continue
+		case !i.needsNotify(now):
+			good++
+		}
+		checked++
+	}
+	problems := int64(checked - good)
+	line := fmt.Sprintf("%d checked, %d good, %d %s", checked, good, problems, pluralize(problems, "problem"))
+	if skipped != 0 {
+		line += fmt.Sprintf(", %d skipped", skipped)
+	}
+	return line
+}
+
+// clockSuspect reports whether so many certs appear expired that the local
+// clock, rather than the certs, is likely wrong.
+func clockSuspect(items []Item, now time.Time) bool {
+	const minChecked = 3
+	var checked, expired int
+	for _, i := range items {
+		if i.err != nil {
+			continue
+		}
+		checked++
+		if i.notAfter.Before(now) {
+			expired++
+		}
+	}
+	return checked >= minChecked && expired*2 > checked
+}
+
+// sharedCerts describes the groups of items that are served the same cert.
+func sharedCerts(items []Item, now time.Time) string {
+	groups := make(map[string][]Item)
+	var order []string
+	for _, i := range items {
+		if i.err != nil {
+			continue
+		}
+		if _, ok := groups[i.fingerprint]; !ok {
+			order = append(order, i.fingerprint)
+		}
+		groups[i.fingerprint] = append(groups[i.fingerprint], i)
+	}
+
+	var buf bytes.Buffer
+	for _, fp := range order {
+		g := groups[fp]
+		if len(g) < 2 {
+			continue
+		}
+		names := make([]string, len(g))
+		for k, i := range g {
+			names[k] = i.domain
+		}
+		fmt.Fprintf(&buf, "\n%d domains share one cert (%s), %s: %s\n",
+			len(g), expiryInfo(g[0].notAfter, now), fp[:16], strings.Join(names, ", "))
+	}
+	return buf.String()
+}
+
+// statsBuckets are the upper bounds, in days remaining, of the histogram in
+// expiryStats. The last bucket is unbounded.
+var statsBuckets = []int64{0, 7, 28, 90}
+
+// expiryStats summarizes the days remaining across the items that were
+// checked successfully.
+func expiryStats(items []Item, now time.Time) string {
+	var days []int64
+	var soonest Item
+	for _, i := range items {
+		if i.err != nil {
+			continue
+		}
+		days = append(days, daysRemaining(i.notAfter, now))
+		if len(days) == 1 || i.notAfter.Before(soonest.notAfter) {
+			soonest = i
+		}
+	}
+	if len(days) == 0 {
+		return ""
+	}
+	sort.Slice(days, func(a, b int) bool { return days[a] < days[b] })
+
+	var median int64
+	if n := len(days); n%2 == 1 {
+		median = days[n/2]
+	} else {
+		median = (days[n/2-1] + days[n/2]) / 2
+	}
+
+	counts := make([]int, len(statsBuckets)+1)
+	for _, d := range days {
+		k := sort.Search(len(statsBuckets), func(k int) bool { return d < statsBuckets[k] })
+		counts[k]++
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "\nexpiry summary for %d %s:\n", len(days), pluralize(int64(len(days)), "cert"))
+	fmt.Fprintf(&buf, "\tmedian %d %s remaining\n", median, pluralize(median, "day"))
+	fmt.Fprintf(&buf, "\tsoonest %s, %s\n", soonest.domain, expiryInfo(soonest.notAfter, now))
+	for k, c := range counts {
+		var label string
+		switch {
+		case k == 0:
+			label = "expired"
+		case k == len(statsBuckets):
+			label = fmt.Sprintf("%d+ days", statsBuckets[k-1])
+		default:
+			label = fmt.Sprintf("%d-%d days", statsBuckets[k-1], statsBuckets[k]-1)
+		}
+		fmt.Fprintf(&buf, "\t%-12s %d\n", label, c)
+	}
+	return buf.String()
+}
+
+// daysRemaining returns the number of whole days until notAfter, rounded
+// down, so that it is negative once notAfter has passed.
+func daysRemaining(notAfter, now time.Time) int64 {
+	const day = 24 * time.Hour
+	d := notAfter.Sub(now)
+	n := int64(d / day)
+	if d < 0 && d%day != 0 {
+		n--
+	}
+	return n
+}
+
+// resultsCSV returns every item not skipped as a CSV record with the columns domain,
+// state, not_after, error, and findings.
+func resultsCSV(items []Item, now time.Time) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"domain", "state", "not_after", "error", "findings"})
+	for _, i := range items {
+		if i.skipped {
+			continue
+		}
+		var notAfter, errStr string
+		if i.err != nil {
+			errStr = i.err.Error()
+		} else {
+			notAfter = i.notAfter.UTC().Format(time.RFC3339)
+		}
+		w.Write([]string{i.domain, string(i.state(now)), notAfter, errStr, strings.Join(i.findings, "; ")})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// jsonItem is the JSON representation of an Item for -format ndjson.
+type jsonItem struct {
+	Domain        string   `json:"domain"`
+	State         state    `json:"state"`
+	NotBefore     string   `json:"not_before,omitempty"` // RFC 3339, UTC
+	NotAfter      string   `json:"not_after,omitempty"`  // RFC 3339, UTC
+	DaysRemaining *int64   `json:"days_remaining,omitempty"`
+	Fingerprint   string   `json:"fingerprint,omitempty"`
+	ChainLength   int      `json:"chain_length,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	Findings      []string `json:"findings,omitempty"`
+}
+
+func (i Item) json(now time.Time) string {
+	b, err := json.Marshal(i.jsonItem(now))
+	if err != nil {
+		panic(err) // not possible for jsonItem
+	}
+	return string(b)
+}
+
+func (i Item) jsonItem(now time.Time) jsonItem {
+	j := jsonItem{
+		Domain:   i.domain,
+		State:    i.state(now),
+		Findings: i.findings,
+	}
+	if i.err != nil {
+		j.Error = i.err.Error()
+	} else {
+		days := daysRemaining(i.notAfter, now)
+		j.NotBefore = i.notBefore.UTC().Format(time.RFC3339)
+		j.NotAfter = i.notAfter.UTC().Format(time.RFC3339)
+		j.DaysRemaining = &days
+		j.Fingerprint = i.fingerprint
+		j.ChainLength = i.chainLength
+	}
+	return j
+}
+
+// writeReport writes report to a file in dir, created if needed, named for
+// the time of the run in UTC and with an extension for -format, such as
+// notafter-20060102-150405.txt.
+func writeReport(dir, report string, now time.Time) error {
+	ext := ".txt"
+	if fFormat.value == "ndjson" {
+		ext = ".ndjson"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	name := "notafter-" + now.UTC().Format("20060102-150405") + ext
+	return os.WriteFile(filepath.Join(dir, name), []byte(report), 0o644)
+}
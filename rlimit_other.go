@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func maxOpenFiles() (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
+
+func isTooManyOpenFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE)
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// maxOpenFiles returns the limit on the number of files the process may
+// have open.
+func maxOpenFiles() (uint64, error) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, err
+	}
+	return uint64(rl.Cur), nil
+}
+
+// isTooManyOpenFiles reports whether err was caused by reaching the
+// process or system open file limit.
+func isTooManyOpenFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
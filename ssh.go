@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// sshExitWait bounds the wait for ssh(1) to exit once its output ends, in
+// order to report why it ended.
+const sshExitWait = 5 * time.Second
+
+// sshDialer dials through the -ssh bastion by running ssh(1) with -W, so
+// that no SSH implementation or extra dependency is needed and the user's
+// ssh configuration applies.
+type sshDialer struct{}
+
+func (sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("ssh: unsupported network %s", network)
+	}
+	args := []string{"-W", addr, "-o", "BatchMode=yes"}
+	if fSSHKey != "" {
+		args = append(args, "-i", fSSHKey)
+	}
+	args = append(args, fSSH)
+
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	c := &sshConn{r: outR, w: inW, addr: addr, exited: make(chan struct{})}
+	c.cmd = exec.Command("ssh", args...)
+	c.cmd.Stdin = inR
+	c.cmd.Stdout = outW
+	c.cmd.Stderr = &c.stderr
+	err = c.cmd.Start()
+	inR.Close()
+	outW.Close()
+	if err != nil {
+		outR.Close()
+		inW.Close()
+		return nil, fmt.Errorf("ssh: %v", err)
+	}
+	go func() {
+		c.waitErr = c.cmd.Wait()
+		close(c.exited)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.exited:
+		}
+	}()
+	return c, nil
+}
+
+// An sshConn is a connection tunneled through ssh(1)'s standard input and
+// output.
+type sshConn struct {
+	cmd    *exec.Cmd
+	r      *os.File
+	w      *os.File
+	addr   string
+	stderr bytes.Buffer // read only after exited is closed
+
+	exited  chan struct{}
+	waitErr error
+}
+
+// Read reads from the tunnel. When the tunnel ends because ssh(1) failed,
+// the error is reported in place of io.EOF, so that it is not mistaken for
+// the server closing the connection.
+func (c *sshConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if !errors.Is(err, io.EOF) {
+		return n, err
+	}
+	t := time.NewTimer(sshExitWait)
+	defer t.Stop()
+	select {
+	case <-c.exited:
+		if c.waitErr != nil {
+			return n, c.sshError()
+		}
+	case <-t.C:
+	}
+	return n, err
+}
+
+// sshError describes the failure of ssh(1) by what it wrote to standard
+// error.
+func (c *sshConn) sshError() error {
+	var msgs []string
+	for _, line := range strings.Split(c.stderr.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			msgs = append(msgs, strings.TrimPrefix(line, "ssh: "))
+		}
+	}
+	if len(msgs) == 0 {
+		return fmt.Errorf("ssh: %v", c.waitErr)
+	}
+	return fmt.Errorf("ssh: %s", strings.Join(msgs, "; "))
+}
+
+func (c *sshConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c *sshConn) Close() error {
+	c.w.Close()
+	c.r.Close()
+	c.cmd.Process.Kill()
+	return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr  { return sshAddr(fSSH) }
+func (c *sshConn) RemoteAddr() net.Addr { return sshAddr(c.addr) }
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+	if err := c.r.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.w.SetWriteDeadline(t)
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error  { return c.r.SetReadDeadline(t) }
+func (c *sshConn) SetWriteDeadline(t time.Time) error { return c.w.SetWriteDeadline(t) }
+
+// An sshAddr is the address at one end of an sshConn.
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
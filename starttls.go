@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// defaultPortProtocols maps the standard ports of the protocols that upgrade
+// a plaintext connection with STARTTLS to the protocol, for
+// -probe-all-protocols. Other ports, such as 443, 465, and 993, speak TLS
+// directly.
+var defaultPortProtocols = map[string]string{
+	"25":  "smtp",
+	"587": "smtp",
+	"143": "imap",
+	"110": "pop3",
+}
+
+// startTLSProtocols lists the protocols that may be given to -port-protocol.
+var startTLSProtocols = []string{"tls", "smtp", "imap", "pop3"}
+
+// portProtocols, if non-nil, maps ports to the protocol spoken before the
+// TLS handshake, from -probe-all-protocols and -port-protocol.
+var portProtocols map[string]string
+
+// loadPortProtocols returns defaultPortProtocols overridden by the
+// "<port>=<protocol>" entries of -port-protocol.
+func loadPortProtocols(entries []string) (map[string]string, error) {
+	out := make(map[string]string, len(defaultPortProtocols)+len(entries))
+	for port, proto := range defaultPortProtocols {
+		out[port] = proto
+	}
+	for _, e := range entries {
+		port, proto, ok := strings.Cut(e, "=")
+		if !ok || port == "" {
+			return nil, fmt.Errorf("-port-protocol: want <port>=<protocol>, got %q", e)
+		}
+		valid := false
+		for _, p := range startTLSProtocols {
+			valid = valid || p == proto
+		}
+		if !valid {
+			return nil, fmt.Errorf("-port-protocol: protocol %q must be one of %s", proto, strings.Join(startTLSProtocols, ", "))
+		}
+		out[port] = proto
+	}
+	return out, nil
+}
+
+// startTLSProtocol returns the protocol in which t negotiates STARTTLS, or
+// "" if t speaks TLS directly.
+func startTLSProtocol(t target) string {
+	if _, ok := t.unixPath(); ok || portProtocols == nil {
+		return ""
+	}
+	_, port := t.hostPort()
+	if proto := portProtocols[port]; proto != "tls" {
+		return proto
+	}
+	return ""
+}
+
+// startTLS negotiates STARTTLS in proto on conn, after which conn is ready
+// for the TLS handshake.
+func startTLS(ctx context.Context, conn net.Conn, proto string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	// The textproto.Conn is not closed, since that would close conn. Servers
+	// send nothing after accepting STARTTLS until the client's hello, so
+	// its buffer holds nothing when it is discarded.
+	tp := textproto.NewConn(conn)
+	switch proto {
+	case "smtp":
+		return startTLSSMTP(tp)
+	case "imap":
+		return startTLSIMAP(tp)
+	case "pop3":
+		return startTLSPOP3(tp)
+	}
+	return fmt.Errorf("unknown protocol %q", proto)
+}
+
+func startTLSSMTP(tp *textproto.Conn) error {
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		return err
+	}
+	if err := tp.PrintfLine("EHLO localhost"); err != nil {
+		return err
+	}
+	if _, msg, err := tp.ReadResponse(250); err != nil {
+		return err
+	} else if !hasSMTPExtension(msg, "STARTTLS") {
+		return errors.New("not offered by the server")
+	}
+	if err := tp.PrintfLine("STARTTLS"); err != nil {
+		return err
+	}
+	_, _, err := tp.ReadResponse(220)
+	return err
+}
+
+// hasSMTPExtension reports whether the EHLO response msg lists ext.
+func hasSMTPExtension(msg, ext string) bool {
+	for _, line := range strings.Split(msg, "\n")[1:] { // the first line is the greeting
+		if f := strings.Fields(line); len(f) != 0 && strings.EqualFold(f[0], ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func startTLSIMAP(tp *textproto.Conn) error {
+	line, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("unexpected greeting %q", line)
+	}
+	const tag = "a1"
+	if err := tp.PrintfLine("%s STARTTLS", tag); err != nil {
+		return err
+	}
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, tag+" ") {
+			continue // untagged response
+		}
+		if !strings.HasPrefix(line, tag+" OK") {
+			return fmt.Errorf("refused: %q", strings.TrimPrefix(line, tag+" "))
+		}
+		return nil
+	}
+}
+
+func startTLSPOP3(tp *textproto.Conn) error {
+	line, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("unexpected greeting %q", line)
+	}
+	if err := tp.PrintfLine("STLS"); err != nil {
+		return err
+	}
+	line, err = tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("refused: %q", line)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+	"strings"
+	"time"
+)
+
+// syslogSupported reports whether -syslog is available on this platform.
+const syslogSupported = true
+
+// writeSyslog logs a line for each item to the local syslog, with a
+// severity according to its state.
+func writeSyslog(items []Item, now time.Time) error {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "notafter")
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for _, i := range items {
+		if i.skipped {
+			continue
+		}
+		line, _, _ := strings.Cut(i.format(now), "\n") // without -verbose details
+		switch i.state(now) {
+		case stateExpired, stateCritical, stateError:
+			err = w.Err(line)
+		case stateWarning:
+			err = w.Warning(line)
+		default:
+			err = w.Info(line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const syslogSupported = false
+
+func writeSyslog(items []Item, now time.Time) error {
+	return errors.New("syslog is not supported on this platform")
+}